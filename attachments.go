@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	pathpkg "path"
+	"strings"
+)
+
+// Attachment as listed in the structure of a message, read without fetching the rest of the message
+type Attachment struct {
+	filename string
+	// MIME part number, e.g. [2 1] for part 2.1
+	part     []int
+	encoding string
+	// decoded size, an estimate unless exact
+	size  int64
+	exact bool
+	// an attached message/rfc822, exposed as a directory like the message it is attached to
+	message bool
+	subject string
+	// attachments of the attached message
+	parts []Attachment
+}
+
+type AttachmentReader interface {
+	// Attachments and inline non-text parts of the message, not fetching their contents
+	attachments(mailbox string, id uint64) ([]Attachment, error)
+	// Decoded contents of the attachment, fetching only its part
+	readAttachment(mailbox string, id uint64, attachment Attachment) ([]byte, error)
+}
+
+func (a Attachment) section() string {
+	var nums []string
+	for _, num := range a.part {
+		nums = append(nums, fmt.Sprint(num))
+	}
+	return strings.Join(nums, ".")
+}
+
+// Names attachments after their filenames and attached messages after their subjects, numbering repeated names.
+// Parts without a name are named after their section
+func attachmentNames(attachments []Attachment) map[string]Attachment {
+	names := make(map[string]Attachment)
+	for _, attachment := range attachments {
+		filename := attachment.filename
+		if attachment.message {
+			filename = attachment.subject
+		}
+		if filename == "" && attachment.message {
+			filename = "message-" + attachment.section()
+		} else if filename == "" {
+			filename = "part-" + attachment.section()
+		}
+		name := ClearFilename(filename)
+		ext := pathpkg.Ext(name)
+		if attachment.message {
+			ext = ""
+		}
+		base := strings.TrimSuffix(name, ext)
+		for i := 2; hasKey(names, name); i++ {
+			name = ClearFilenameWithSuffix(base, fmt.Sprintf(" (%d)%s", i, ext))
+		}
+		names[name] = attachment
+	}
+	return names
+}
+
+// Adds attachments to paths by their path in the message directory, including attachments of attached messages
+func attachmentPaths(dir string, attachments []Attachment, paths map[string]Attachment) {
+	for name, attachment := range attachmentNames(attachments) {
+		path := pathpkg.Join(dir, attachmentsDir, name)
+		paths[path] = attachment
+		if attachment.message {
+			attachmentPaths(path, attachment.parts, paths)
+		}
+	}
+}
+
+func hasKey[V any](m map[string]V, key string) bool {
+	_, found := m[key]
+	return found
+}
+
+// Decoded size of a part of the given size in its transfer encoding, reports whether it is exact.
+// Line lengths and soft line breaks are unknown until the part is read, so only unencoded sizes are exact
+func decodedSize(encoding string, size int64) (int64, bool) {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		// encoders wrap lines at 76 characters, each 4 characters hold 3 bytes
+		lines := (size + 77) / 78
+		return max(size-2*lines, 0) * 3 / 4, false
+	case "quoted-printable":
+		return size, false
+	}
+	return size, true
+}
+
+// Decodes a part fetched in its transfer encoding
+func decodePart(encoding string, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(encoding) {
+	case "base64":
+		// the decoder skips line breaks
+		r = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data))
+	case "quoted-printable":
+		r = quotedprintable.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+)
+
+// Encodes the data as mail encoders do, wrapping lines at 76 characters
+func encodePart(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	switch encoding {
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString(data)
+		var lines []string
+		for ; len(encoded) > 76; encoded = encoded[76:] {
+			lines = append(lines, encoded[:76])
+		}
+		return []byte(strings.Join(append(lines, encoded), "\r\n") + "\r\n")
+	case "quoted-printable":
+		var buf bytes.Buffer
+		w := quotedprintable.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	return data
+}
+
+func TestDecodedSize(t *testing.T) {
+	binary := bytes.Repeat([]byte{0, 0xff, 'a', '='}, 300)
+	text := []byte(strings.Repeat("naïve café = crème brûlée\r\n", 20))
+	tests := []struct {
+		encoding string
+		data     []byte
+		exact    bool
+		// how far the estimate may be off
+		tolerance int64
+		// the encoded size is reported, which is never short of the decoded one
+		upperBound bool
+	}{
+		{encoding: "7bit", data: []byte("plain text\r\n"), exact: true},
+		{encoding: "8bit", data: text, exact: true},
+		{encoding: "binary", data: binary, exact: true},
+		{encoding: "", data: []byte("no encoding"), exact: true},
+		{encoding: "base64", data: binary, tolerance: 2},
+		{encoding: "base64", data: []byte("a"), tolerance: 2},
+		{encoding: "base64", data: bytes.Repeat([]byte{1}, 57), tolerance: 2},
+		{encoding: "base64", data: nil},
+		{encoding: "quoted-printable", data: text, upperBound: true},
+		{encoding: "quoted-printable", data: []byte("plain ascii"), upperBound: true},
+	}
+	for _, test := range tests {
+		encoded := encodePart(t, test.encoding, test.data)
+		for _, encoding := range []string{test.encoding, strings.ToUpper(test.encoding)} {
+			size, exact := decodedSize(encoding, int64(len(encoded)))
+			if test.upperBound {
+				if exact || size != int64(len(encoded)) || size < int64(len(test.data)) {
+					t.Errorf("decodedSize %s exp %d not exact, got %d exact %t", encoding, len(encoded), size, exact)
+				}
+				continue
+			}
+			if diff := size - int64(len(test.data)); exact != test.exact || diff < -test.tolerance || diff > test.tolerance {
+				t.Errorf("decodedSize %s of %d bytes exp %d±%d exact %t, got %d exact %t", encoding, len(encoded), len(test.data), test.tolerance, test.exact, size, exact)
+			}
+		}
+	}
+}
+
+func TestDecodePart(t *testing.T) {
+	binary := bytes.Repeat([]byte{0, 0xff, 'a', '='}, 300)
+	text := []byte(strings.Repeat("naïve café = crème brûlée\r\n", 20))
+	tests := []struct {
+		encoding string
+		data     []byte
+	}{
+		{encoding: "7bit", data: []byte("plain text\r\n")},
+		{encoding: "8bit", data: text},
+		{encoding: "binary", data: binary},
+		{encoding: "", data: []byte("no encoding")},
+		{encoding: "base64", data: binary},
+		{encoding: "base64", data: []byte("a")},
+		{encoding: "quoted-printable", data: text},
+		{encoding: "quoted-printable", data: []byte(strings.Repeat("long line without breaks ", 10))},
+	}
+	for _, test := range tests {
+		encoded := encodePart(t, test.encoding, test.data)
+		for _, encoding := range []string{test.encoding, strings.ToUpper(test.encoding)} {
+			decoded, err := decodePart(encoding, encoded)
+			if err != nil || !bytes.Equal(decoded, test.data) {
+				t.Errorf("decodePart %s exp %q got %q, err %v", encoding, test.data, decoded, err)
+			}
+		}
+	}
+
+	if _, err := decodePart("base64", []byte("not base64!")); err == nil {
+		t.Errorf("Exp an error decoding invalid base64")
+	}
+}
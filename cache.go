@@ -0,0 +1,28 @@
+package main
+
+// Keeps values stored last, dropping the oldest ones over the limit
+type recentCache[K comparable, V any] struct {
+	limit  int
+	values map[K]V
+	order  []K
+}
+
+func newRecentCache[K comparable, V any](limit int) *recentCache[K, V] {
+	return &recentCache[K, V]{limit: limit, values: make(map[K]V)}
+}
+
+func (self *recentCache[K, V]) get(key K) (V, bool) {
+	value, found := self.values[key]
+	return value, found
+}
+
+func (self *recentCache[K, V]) put(key K, value V) {
+	if _, found := self.values[key]; !found {
+		self.order = append(self.order, key)
+	}
+	self.values[key] = value
+	if len(self.order) > self.limit {
+		delete(self.values, self.order[0])
+		self.order = self.order[1:]
+	}
+}
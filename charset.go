@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message/charset"
+)
+
+// Chooses what happens to text with bytes invalid in the charset it is declared in
+type charsetMode string
+
+const (
+	// invalid bytes are replaced with U+FFFD
+	charsetReplace charsetMode = "replace"
+	// text with invalid bytes is kept as is
+	charsetRaw charsetMode = "raw"
+)
+
+func parseCharsetMode(value string) (charsetMode, error) {
+	switch mode := charsetMode(value); mode {
+	case charsetReplace, charsetRaw:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown charset mode %s", value)
+}
+
+// Converts text in the charset to UTF-8, to be set as message.CharsetReader.
+// Importing go-message/charset sets it to the replace mode. In the raw mode text is decoded line by line,
+// as multibyte and stateful charsets can't be decoded byte by byte, so a line with invalid bytes is kept whole
+func (mode charsetMode) reader(name string, input io.Reader) (io.Reader, error) {
+	if mode != charsetRaw {
+		return charset.Reader(name, input)
+	}
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	replacement := []byte(string(utf8.RuneError))
+	var decoded bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		decoder, err := charset.Reader(name, bytes.NewReader(line))
+		if err != nil {
+			return nil, err
+		}
+		decodedLine, err := io.ReadAll(decoder)
+		if err != nil {
+			return nil, err
+		}
+		// decoders replace what they can't decode, only UTF-8 text holds the replacement character otherwise
+		if bytes.Count(decodedLine, replacement) > bytes.Count(line, replacement) {
+			decodedLine = line
+		}
+		decoded.Write(decodedLine)
+	}
+	return &decoded, nil
+}
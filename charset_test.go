@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseEmailCharset(t *testing.T) {
+	raw := "Subject: =?koi8-r?B?8NLJ18XU?=\r\nContent-Type: text/plain; charset=windows-1251\r\n\r\n\xcf\xf0\xe8\xe2\xe5\xf2"
+	parts, err := parseEmail([]byte(raw), messageKeys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "Привет"; string(parts.text) != exp {
+		t.Errorf("Exp text %q got %q", exp, parts.text)
+	}
+	if exp := "Subject: Привет\r\n"; !strings.HasPrefix(string(parts.header), exp) {
+		t.Errorf("Exp header %q got %q", exp, parts.header)
+	}
+}
+
+func TestCharsetMode(t *testing.T) {
+	tests := []struct {
+		mode    charsetMode
+		charset string
+		input   string
+		exp     string
+	}{
+		{charsetReplace, "shift_jis", "\x82\xa0 \x81 ", "あ � "},
+		{charsetRaw, "shift_jis", "\x82\xa0 \x81 ", "\x82\xa0 \x81 "},
+		{charsetRaw, "shift_jis", "\x82\xa0", "あ"},
+		{charsetRaw, "iso-8859-2", "\xb1", "ą"},
+		{charsetRaw, "shift_jis", "\x82\xa0\r\n\x81 \r\n\x82\xa0", "あ\r\n\x81 \r\nあ"},
+	}
+	for _, test := range tests {
+		r, err := test.mode.reader(test.charset, strings.NewReader(test.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := io.ReadAll(r); string(got) != test.exp {
+			t.Errorf("%s %s of %q exp %q got %q", test.mode, test.charset, test.input, test.exp, got)
+		}
+	}
+}
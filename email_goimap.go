@@ -1,64 +1,257 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
 )
 
 type GoImapEmailInterface struct {
-	c        *imapclient.Client
-	fetchCmd *imapclient.FetchCommand
+	c *imapclient.Client
+	// sends Gmail extension commands, nil on other servers
+	gmail    *GmailImap
+	lock     sync.Mutex
+	selected string
+	fetched  []EmailMetadata
 }
 
-func (self *GoImapEmailInterface) initFetch(lastMessagesCount uint32) error {
-	mbox, err := self.c.Select("INBOX", nil).Wait()
+func (self *GoImapEmailInterface) listMailboxes() ([]Mailbox, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	listData, err := self.c.List("", "*", nil).Collect()
 	if err != nil {
+		return nil, err
+	}
+	var mailboxes []Mailbox
+	for _, v := range listData {
+		noSelect := slices.Contains(v.Attrs, imap.MailboxAttrNoSelect) || slices.Contains(v.Attrs, imap.MailboxAttrNonExistent)
+		all := slices.Contains(v.Attrs, imap.MailboxAttrAll)
+		mailboxes = append(mailboxes, Mailbox{name: v.Mailbox, delim: v.Delim, noSelect: noSelect, all: all})
+	}
+	return mailboxes, nil
+}
+
+// Selects the mailbox unless it is selected already, the caller must hold the lock
+func (self *GoImapEmailInterface) selectMailbox(mailbox string) error {
+	if self.selected == mailbox {
+		return nil
+	}
+	if _, err := self.c.Select(mailbox, nil).Wait(); err != nil {
+		self.selected = ""
 		return err
 	}
+	self.selected = mailbox
+	return nil
+}
+
+func (self *GoImapEmailInterface) initFetch(mailbox string, lastMessagesCount uint32) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.fetched = nil
+	mbox, err := self.c.Select(mailbox, nil).Wait()
+	if err != nil {
+		self.selected = ""
+		return err
+	}
+	self.selected = mailbox
+	if mbox.NumMessages == 0 {
+		return nil
+	}
 
-	fetchOpts := imap.FetchOptions{Envelope: true, UID: true, RFC822Size: true}
 	seqset := imap.SeqSet{}
 	var start, stop uint32
 	stop = mbox.NumMessages
-	if mbox.NumMessages < lastMessagesCount {
-		start = 0
+	if mbox.NumMessages <= lastMessagesCount {
+		start = 1
 	} else {
-		start = mbox.NumMessages - lastMessagesCount
+		start = mbox.NumMessages - lastMessagesCount + 1
 	}
 	seqset.AddRange(start, stop)
-	self.fetchCmd = self.c.Fetch(seqset, &fetchOpts)
+
+	// Messages are collected at once so other commands can use the connection in between fetchNext calls
+	self.fetched, err = self.fetchMetadata(mailbox, seqset)
+	if err != nil {
+		return errors.Join(err, errors.New("msg reading error"))
+	}
+
+	if self.c.Caps().Has(imap.Cap("THREAD=REFERENCES")) {
+		if err := self.addServerThreads(); err != nil {
+			log.Printf("Failed to fetch threads of %s: %v", mailbox, err)
+		}
+	}
 	return nil
 }
 
-func (self *GoImapEmailInterface) fetchNext() (EmailMetadata, error) {
-	pMsg := self.fetchCmd.Next()
-	if pMsg == nil {
-		closeErr := self.fetchCmd.Close()
-		return EmailMetadata{}, errors.Join(closeErr, errors.New("no more messages"))
+// Metadata of messages listed, the caller must hold the lock with the mailbox selected
+func (self *GoImapEmailInterface) fetchMetadata(mailbox string, numSet imap.NumSet) ([]EmailMetadata, error) {
+	headerSection := &imap.FetchItemBodySection{Specifier: imap.PartSpecifierHeader, HeaderFields: []string{"References", "List-ID"}, Peek: true}
+	fetchOpts := imap.FetchOptions{
+		Envelope:     true,
+		Flags:        true,
+		UID:          true,
+		RFC822Size:   true,
+		InternalDate: true,
+		// tells what the message file holds, so it gets its extension before it is read
+		BodyStructure: &imap.FetchItemBodyStructure{Extended: true},
+		BodySection:   []*imap.FetchItemBodySection{headerSection},
 	}
-	msg, err := pMsg.Collect()
+	msgs, err := self.c.Fetch(numSet, &fetchOpts).Collect()
 	if err != nil {
-		closeErr := self.fetchCmd.Close()
-		return EmailMetadata{}, errors.Join(err, closeErr, errors.New("msg reading error"))
+		return nil, err
 	}
-	var subject string
-	if msg.Envelope != nil {
-		subject = msg.Envelope.Subject
+	var emails []EmailMetadata
+	for _, msg := range msgs {
+		email := EmailMetadata{uid: uint64(msg.UID), bodyLen: msg.RFC822Size, internalDate: msg.InternalDate}
+		header := parseHeader(msg.FindBodySection(headerSection))
+		email.references, _ = header.MsgIDList("References")
+		email.listId, _ = header.Text("List-ID")
+		for _, flag := range msg.Flags {
+			email.flags = append(email.flags, string(flag))
+		}
+		slices.Sort(email.flags)
+		if msg.BodyStructure != nil {
+			email.bodyTypes = inlineTextTypes(msg.BodyStructure)
+			email.secured = isSecured(msg.BodyStructure)
+		}
+		if msg.Envelope != nil {
+			email.references = append(email.references, msg.Envelope.InReplyTo...)
+			email.subject = msg.Envelope.Subject
+			email.messageId = msg.Envelope.MessageID
+			email.date = msg.Envelope.Date
+			if len(msg.Envelope.From) > 0 {
+				email.from = EmailAddress{name: msg.Envelope.From[0].Name, address: msg.Envelope.From[0].Addr()}
+			}
+			email.to = envelopeAddresses(msg.Envelope.To)
+			email.cc = envelopeAddresses(msg.Envelope.Cc)
+		}
+		emails = append(emails, email)
+	}
+
+	if self.gmail != nil {
+		if err := self.addGmailIds(mailbox, emails); err != nil {
+			log.Printf("Failed to fetch Gmail message IDs of %s: %v", mailbox, err)
+		}
+	}
+	return emails, nil
+}
+
+// Sets X-GM-MSGIDs of the messages
+func (self *GoImapEmailInterface) addGmailIds(mailbox string, emails []EmailMetadata) error {
+	var uids []uint64
+	for _, email := range emails {
+		uids = append(uids, email.uid)
+	}
+	ids, err := self.gmail.messageIds(mailbox, uids)
+	if err != nil {
+		return err
+	}
+	for i := range emails {
+		emails[i].gmailId = ids[emails[i].uid]
 	}
-	return EmailMetadata{subject: subject, uid: uint64(msg.UID), bodyLen: msg.RFC822Size}, nil
+	return nil
 }
 
-func (self *GoImapEmailInterface) read(id uint64) string {
+// Links fetched messages to the first message of their server side thread, the caller must hold the lock
+func (self *GoImapEmailInterface) addServerThreads() error {
+	fetchedByUids := make(map[uint64]*EmailMetadata)
+	var uids []imap.UID
+	for i := range self.fetched {
+		fetchedByUids[self.fetched[i].uid] = &self.fetched[i]
+		uids = append(uids, imap.UID(self.fetched[i].uid))
+	}
+	threadOpts := &imapclient.ThreadOptions{
+		Algorithm:      imap.ThreadReferences,
+		SearchCriteria: &imap.SearchCriteria{UID: []imap.UIDSet{imap.UIDSetNum(uids...)}},
+	}
+	threads, err := self.c.UIDThread(threadOpts).Wait()
+	if err != nil {
+		return err
+	}
+
+	for _, thread := range threads {
+		var first *EmailMetadata
+		for _, uid := range threadUids(thread) {
+			email, found := fetchedByUids[uint64(uid)]
+			if !found || email.messageId == "" {
+				continue
+			}
+			if first == nil {
+				first = email
+			} else {
+				email.references = append(email.references, first.messageId)
+			}
+		}
+	}
+	return nil
+}
+
+func threadUids(thread imapclient.ThreadData) []uint32 {
+	uids := slices.Clone(thread.Chain)
+	for _, subThread := range thread.SubThreads {
+		uids = append(uids, threadUids(subThread)...)
+	}
+	return uids
+}
+
+// Parses header fields fetched along with the envelope, a missing or malformed header has no fields
+func parseHeader(headerBytes []byte) mail.Header {
+	if headerBytes == nil {
+		return mail.Header{}
+	}
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(headerBytes)))
+	if err != nil {
+		return mail.Header{}
+	}
+	return mail.Header{Header: message.Header{Header: header}}
+}
+
+func envelopeAddresses(addresses []imap.Address) []EmailAddress {
+	var emailAddresses []EmailAddress
+	for _, address := range addresses {
+		if address.IsGroupStart() || address.IsGroupEnd() {
+			continue
+		}
+		emailAddresses = append(emailAddresses, EmailAddress{name: address.Name, address: address.Addr()})
+	}
+	return emailAddresses
+}
+
+func (self *GoImapEmailInterface) fetchNext() (EmailMetadata, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.fetched) == 0 {
+		return EmailMetadata{}, errors.New("no more messages")
+	}
+	msg := self.fetched[0]
+	self.fetched = self.fetched[1:]
+	return msg, nil
+}
+
+// Fetches the whole message as it is stored on the server
+func (self *GoImapEmailInterface) readRaw(mailbox string, id uint64) ([]byte, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.selectMailbox(mailbox); err != nil {
+		return nil, errors.New("mailbox select error")
+	}
 	seqSet := imap.UIDSetNum(imap.UID(id))
-	bodySection := &imap.FetchItemBodySection{}
+	// listing parts and checking signatures read the message too, only opening its text marks it seen
+	bodySection := &imap.FetchItemBodySection{Peek: true}
 	fetchOptions := &imap.FetchOptions{
 		UID:         true,
 		BodySection: []*imap.FetchItemBodySection{bodySection},
@@ -68,66 +261,180 @@ func (self *GoImapEmailInterface) read(id uint64) string {
 
 	msg := fetchCmd.Next()
 	if msg == nil {
-		return "msg receive error"
+		return nil, errors.New("msg receive error")
 	}
 
 	msgBuf, err := msg.Collect()
 	if err != nil || msgBuf == nil {
-		return "msg collect err"
+		return nil, errors.New("msg collect err")
 	}
 
 	msgBytes := msgBuf.FindBodySection(bodySection)
 	if msgBytes == nil {
-		return "msg read errrrrrrrrrrrrrrrrr"
+		return nil, errors.New("msg read errrrrrrrrrrrrrrrrr")
 	}
+	return msgBytes, nil
+}
 
-	mr, err := mail.CreateReader(bytes.NewReader(msgBytes))
+func (self *GoImapEmailInterface) attachments(mailbox string, id uint64) ([]Attachment, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.selectMailbox(mailbox); err != nil {
+		return nil, fmt.Errorf("failed to select mailbox %s: %v", mailbox, err)
+	}
+	uidSet := imap.UIDSetNum(imap.UID(id))
+	fetchOptions := &imap.FetchOptions{UID: true, BodyStructure: &imap.FetchItemBodyStructure{Extended: true}}
+	msgs, err := self.c.Fetch(uidSet, fetchOptions).Collect()
 	if err != nil {
-		log.Fatalf("failed to create mail reader: %v", err)
+		return nil, err
+	}
+	if len(msgs) == 0 || msgs[0].BodyStructure == nil {
+		return nil, errors.New("no body structure")
 	}
 
-	// Print a few header fields
-	// h := mr.Header
-	// if date, err := h.Date(); err != nil {
-	// 	log.Printf("failed to parse Date header field: %v", err)
-	// } else {
-	// 	log.Printf("Date: %v", date)
-	// }
-	// if to, err := h.AddressList("To"); err != nil {
-	// 	log.Printf("failed to parse To header field: %v", err)
-	// } else {
-	// 	log.Printf("To: %v", to)
-	// }
-	// if subject, err := h.Text("Subject"); err != nil {
-	// 	log.Printf("failed to parse Subject header field: %v", err)
-	// } else {
-	// 	log.Printf("Subject: %v", subject)
-	// }
+	attachments := bodyAttachments(msgs[0].BodyStructure, nil)
+	if len(attachments) == 0 || !self.c.Caps().Has(imap.CapBinary) {
+		return attachments, nil
+	}
 
-	var sbuf strings.Builder
-	for {
-		p, err := mr.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Fatalf("failed to read message part: %v", err)
+	// the server reports exact decoded sizes
+	fetchOptions = &imap.FetchOptions{UID: true}
+	walkAttachments(attachments, func(attachment *Attachment) {
+		fetchOptions.BinarySectionSize = append(fetchOptions.BinarySectionSize, &imap.FetchItemBinarySectionSize{Part: attachment.part})
+	})
+	msgs, err = self.c.Fetch(uidSet, fetchOptions).Collect()
+	if err != nil || len(msgs) == 0 {
+		log.Printf("failed to fetch attachment sizes of %d in %s: %v", id, mailbox, err)
+		return attachments, nil
+	}
+	walkAttachments(attachments, func(attachment *Attachment) {
+		if size, found := msgs[0].FindBinarySectionSize(attachment.part); found {
+			attachment.size = int64(size)
+			attachment.exact = true
 		}
+	})
+	return attachments, nil
+}
 
-		switch h := p.Header.(type) {
-		case *mail.InlineHeader:
-			mediaType, _, _ := h.ContentType()
-			log.Println("Content type: ", mediaType)
-			if mediaType == "text/plain" {
-				b, _ := io.ReadAll(p.Body)
-				sbuf.Write(b)
+// Lists attachments in the body structure of a message, prefix is the part number of an attached message
+func bodyAttachments(bodyStructure imap.BodyStructure, prefix []int) []Attachment {
+	var attachments []Attachment
+	bodyStructure.Walk(func(path []int, part imap.BodyStructure) bool {
+		singlePart, ok := part.(*imap.BodyStructureSinglePart)
+		if !ok {
+			// the control part and the ciphertext of an encrypted message are not its attachments
+			return !strings.EqualFold(part.(*imap.BodyStructureMultiPart).Subtype, "encrypted")
+		}
+		path = append(slices.Clone(prefix), path...)
+		if message := singlePart.MessageRFC822; message != nil && singlePart.MediaType() == "message/rfc822" {
+			attachment := Attachment{message: true, part: path, encoding: singlePart.Encoding, size: int64(singlePart.Size), exact: true}
+			if message.Envelope != nil {
+				attachment.subject = message.Envelope.Subject
 			}
-			// case *mail.AttachmentHeader:
-			// 	// This is an attachment
-			// 	filename, _ := h.Filename()
-			// 	log.Printf("Attachment: %v", filename)
+			if message.BodyStructure != nil {
+				attachment.parts = bodyAttachments(message.BodyStructure, path)
+			}
+			attachments = append(attachments, attachment)
+			return false
+		}
+		disposition := ""
+		if part.Disposition() != nil {
+			disposition = strings.ToLower(part.Disposition().Value)
+		}
+		mediaType := singlePart.MediaType()
+		if disposition != "attachment" && (mediaType == "text/plain" || mediaType == "text/html") {
+			return false
+		}
+		if mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime" {
+			// an S/MIME encrypted or signed message, not an attachment of it
+			return false
+		}
+		size, exact := decodedSize(singlePart.Encoding, int64(singlePart.Size))
+		attachments = append(attachments, Attachment{
+			filename: singlePart.Filename(),
+			part:     path,
+			encoding: singlePart.Encoding,
+			size:     size,
+			exact:    exact,
+		})
+		return false
+	})
+	return attachments
+}
+
+// Media types of text parts which are not attachments, leaving out attached messages
+func inlineTextTypes(bodyStructure imap.BodyStructure) []string {
+	var types []string
+	bodyStructure.Walk(func(path []int, part imap.BodyStructure) bool {
+		singlePart, ok := part.(*imap.BodyStructureSinglePart)
+		if !ok {
+			return true
+		}
+		if part.Disposition() != nil && strings.EqualFold(part.Disposition().Value, "attachment") {
+			return false
+		}
+		if mediaType := singlePart.MediaType(); strings.HasPrefix(mediaType, "text/") && !slices.Contains(types, mediaType) {
+			types = append(types, mediaType)
+		}
+		return false
+	})
+	return types
+}
+
+// Reports whether the message is signed or encrypted as a whole
+func isSecured(bodyStructure imap.BodyStructure) bool {
+	switch part := bodyStructure.(type) {
+	case *imap.BodyStructureMultiPart:
+		subtype := strings.ToLower(part.Subtype)
+		return subtype == "signed" || subtype == "encrypted"
+	case *imap.BodyStructureSinglePart:
+		mediaType := part.MediaType()
+		return mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime"
+	}
+	return false
+}
+
+// Calls f for every attachment which is not a message, including attachments of attached messages
+func walkAttachments(attachments []Attachment, f func(attachment *Attachment)) {
+	for i := range attachments {
+		if attachments[i].message {
+			walkAttachments(attachments[i].parts, f)
+		} else {
+			f(&attachments[i])
 		}
 	}
-	return sbuf.String()
+}
+
+func (self *GoImapEmailInterface) readAttachment(mailbox string, id uint64, attachment Attachment) ([]byte, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.selectMailbox(mailbox); err != nil {
+		return nil, fmt.Errorf("failed to select mailbox %s: %v", mailbox, err)
+	}
+	uidSet := imap.UIDSetNum(imap.UID(id))
+	if self.c.Caps().Has(imap.CapBinary) {
+		binarySection := &imap.FetchItemBinarySection{Part: attachment.part, Peek: true}
+		msgs, err := self.c.Fetch(uidSet, &imap.FetchOptions{UID: true, BinarySection: []*imap.FetchItemBinarySection{binarySection}}).Collect()
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			return nil, errors.New("msg receive error")
+		}
+		return msgs[0].FindBinarySection(binarySection), nil
+	}
+
+	bodySection := &imap.FetchItemBodySection{Part: attachment.part, Peek: true}
+	msgs, err := self.c.Fetch(uidSet, &imap.FetchOptions{UID: true, BodySection: []*imap.FetchItemBodySection{bodySection}}).Collect()
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, errors.New("msg receive error")
+	}
+	return decodePart(attachment.encoding, msgs[0].FindBodySection(bodySection))
 }
 
 func (self *GoImapEmailInterface) Logout() {
@@ -135,7 +442,13 @@ func (self *GoImapEmailInterface) Logout() {
 	self.c.Close()
 }
 
-func (self *GoImapEmailInterface) remove(id uint64) error {
+func (self *GoImapEmailInterface) remove(mailbox string, id uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.selectMailbox(mailbox); err != nil {
+		return fmt.Errorf("failed to select mailbox %s: %v", mailbox, err)
+	}
 	uidSet := imap.UIDSetNum(imap.UID(id))
 
 	// Gmail-specific deletion: Move to Trash folder instead of marking as deleted
@@ -209,39 +522,230 @@ func (self *GoImapEmailInterface) remove(id uint64) error {
 	// return nil
 }
 
+// Moves the message to another mailbox, returning its new UID or 0 when the server does not report it
+func (self *GoImapEmailInterface) move(mailbox string, id uint64, dest string) (uint64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.selectMailbox(mailbox); err != nil {
+		return 0, fmt.Errorf("failed to select mailbox %s: %v", mailbox, err)
+	}
+	// falls back to COPY+STORE+EXPUNGE when the server lacks MOVE
+	moveData, err := self.c.Move(imap.UIDSetNum(imap.UID(id)), dest).Wait()
+	if err != nil {
+		return 0, fmt.Errorf("failed to move message to %s: %v", dest, err)
+	}
+	if destUids, ok := moveData.DestUIDs.(imap.UIDSet); ok {
+		if uids, ok := destUids.Nums(); ok && len(uids) == 1 {
+			return uint64(uids[0]), nil
+		}
+	}
+	return 0, nil
+}
+
+// Copies the message to the label mailbox, which Gmail treats as adding the label
+func (self *GoImapEmailInterface) addLabel(mailbox string, id uint64, label string) (uint64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.selectMailbox(mailbox); err != nil {
+		return 0, fmt.Errorf("failed to select mailbox %s: %v", mailbox, err)
+	}
+	copyData, err := self.c.Copy(imap.UIDSetNum(imap.UID(id)), label).Wait()
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy message to %s: %v", label, err)
+	}
+	if uids, ok := copyData.DestUIDs.Nums(); ok && len(uids) == 1 {
+		return uint64(uids[0]), nil
+	}
+	return 0, nil
+}
+
+// Expunges the message from the label mailbox, which Gmail treats as removing the label only
+func (self *GoImapEmailInterface) removeLabel(mailbox string, id uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.selectMailbox(mailbox); err != nil {
+		return fmt.Errorf("failed to select mailbox %s: %v", mailbox, err)
+	}
+	uidSet := imap.UIDSetNum(imap.UID(id))
+	storeFlags := &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Silent: true,
+		Flags:  []imap.Flag{imap.FlagDeleted},
+	}
+	if err := self.c.Store(uidSet, storeFlags, nil).Close(); err != nil {
+		return fmt.Errorf("failed to mark message as deleted: %v", err)
+	}
+	if err := self.c.UIDExpunge(uidSet).Close(); err != nil {
+		return fmt.Errorf("failed to expunge message: %v", err)
+	}
+	return nil
+}
+
+// Replaces the flags and keywords of the message with UID STORE
+func (self *GoImapEmailInterface) setFlags(mailbox string, id uint64, flags []string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.selectMailbox(mailbox); err != nil {
+		return fmt.Errorf("failed to select mailbox %s: %v", mailbox, err)
+	}
+	storeFlags := &imap.StoreFlags{Op: imap.StoreFlagsSet, Silent: true}
+	for _, flag := range flags {
+		storeFlags.Flags = append(storeFlags.Flags, imap.Flag(flag))
+	}
+	if err := self.c.Store(imap.UIDSetNum(imap.UID(id)), storeFlags, nil).Close(); err != nil {
+		return fmt.Errorf("failed to store flags: %v", err)
+	}
+	return nil
+}
+
+func (self *GoImapEmailInterface) search(mailbox string, query string) ([]uint64, error) {
+	criteria, err := parseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.selectMailbox(mailbox); err != nil {
+		return nil, fmt.Errorf("failed to select mailbox %s: %v", mailbox, err)
+	}
+	searchData, err := self.c.UIDSearch(criteria, nil).Wait()
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint64
+	for _, uid := range searchData.AllUIDs() {
+		uids = append(uids, uint64(uid))
+	}
+	return uids, nil
+}
+
+func (self *GoImapEmailInterface) fetch(mailbox string, uids []uint64) ([]EmailMetadata, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.selectMailbox(mailbox); err != nil {
+		return nil, fmt.Errorf("failed to select mailbox %s: %v", mailbox, err)
+	}
+	var uidSet imap.UIDSet
+	for _, uid := range uids {
+		uidSet.AddNum(imap.UID(uid))
+	}
+	return self.fetchMetadata(mailbox, uidSet)
+}
+
+func (self *GoImapEmailInterface) createMailbox(name string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.c.Create(name, nil).Wait()
+}
+
+func (self *GoImapEmailInterface) deleteMailbox(name string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	status, err := self.c.Status(name, &imap.StatusOptions{NumMessages: true}).Wait()
+	if err != nil {
+		return err
+	}
+	if status.NumMessages != nil && *status.NumMessages > 0 {
+		return errMailboxNotEmpty
+	}
+	// a mailbox cannot be deleted while selected on some servers
+	if self.selected == name {
+		if err := self.c.Unselect().Wait(); err != nil {
+			return err
+		}
+		self.selected = ""
+	}
+	return self.c.Delete(name).Wait()
+}
+
+func (self *GoImapEmailInterface) renameMailbox(name string, newName string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.c.Rename(name, newName).Wait(); err != nil {
+		return err
+	}
+	if self.selected == name {
+		self.selected = newName
+	}
+	return nil
+}
+
 type EmailInterface interface {
-	initFetch(lastMessagesCount uint32) error
+	listMailboxes() ([]Mailbox, error)
+	initFetch(mailbox string, lastMessagesCount uint32) error
 	fetchNext() (EmailMetadata, error)
-	read(id uint64) string
-	remove(id uint64) error
+	readRaw(mailbox string, id uint64) ([]byte, error)
+	attachments(mailbox string, id uint64) ([]Attachment, error)
+	readAttachment(mailbox string, id uint64, attachment Attachment) ([]byte, error)
+	remove(mailbox string, id uint64) error
+	move(mailbox string, id uint64, dest string) (uint64, error)
+	addLabel(mailbox string, id uint64, label string) (uint64, error)
+	removeLabel(mailbox string, id uint64) error
+	setFlags(mailbox string, id uint64, flags []string) error
+	search(mailbox string, query string) ([]uint64, error)
+	fetch(mailbox string, uids []uint64) ([]EmailMetadata, error)
+	createMailbox(name string) error
+	deleteMailbox(name string) error
+	renameMailbox(name string, newName string) error
 }
 
 type GoImapUpdatesNotifier struct {
 	reader EmailInterface
 }
 
-func (s *GoImapUpdatesNotifier) notify(knownMessages []EmailMetadata, newMessages chan<- EmailMetadata, removedMessages chan<- EmailMetadata) {
-	removedMessagesByUids := make(map[uint64]EmailMetadata)
+func (s *GoImapUpdatesNotifier) notify(knownMessages []EmailMetadata, mailboxes chan<- []Mailbox, newMessages chan<- EmailMetadata, removedMessages chan<- EmailMetadata) {
+	removedMessagesByIds := make(map[emailId]EmailMetadata)
 	for _, v := range knownMessages {
-		removedMessagesByUids[v.uid] = v
+		removedMessagesByIds[v.id()] = v
 	}
-	err := s.reader.initFetch(100)
+	mailboxList, err := s.reader.listMailboxes()
 	if err != nil {
-		log.Fatalf("failed to init fetch: %v", err)
+		log.Printf("failed to list mailboxes: %v", err)
+		return
 	}
+	mailboxes <- mailboxList
 
-	for emailsMetadata, err := s.reader.fetchNext(); err == nil; emailsMetadata, err = s.reader.fetchNext() {
-		if emailsMetadata.bodyLen == 0 {
+	for _, mailbox := range mailboxList {
+		if mailbox.noSelect {
 			continue
 		}
-		_, known := removedMessagesByUids[emailsMetadata.uid]
-		if known {
-			delete(removedMessagesByUids, emailsMetadata.uid)
-		} else {
-			newMessages <- emailsMetadata
+		err := s.reader.initFetch(mailbox.name, 100)
+		if err != nil {
+			log.Printf("failed to init fetch of %s: %v", mailbox.name, err)
+			// mailbox state is unknown, keep its messages until the next update
+			for id, v := range removedMessagesByIds {
+				if v.mailbox.name == mailbox.name {
+					delete(removedMessagesByIds, id)
+				}
+			}
+			continue
+		}
+
+		for emailsMetadata, err := s.reader.fetchNext(); err == nil; emailsMetadata, err = s.reader.fetchNext() {
+			if emailsMetadata.bodyLen == 0 {
+				continue
+			}
+			emailsMetadata.mailbox = mailbox
+			knownMessage, known := removedMessagesByIds[emailsMetadata.id()]
+			if known {
+				delete(removedMessagesByIds, emailsMetadata.id())
+			}
+			// a message with changed flags replaces the known one
+			if !known || !slices.Equal(knownMessage.flags, emailsMetadata.flags) {
+				newMessages <- emailsMetadata
+			}
 		}
 	}
-	for _, v := range removedMessagesByUids {
+	for _, v := range removedMessagesByIds {
 		removedMessages <- v
 	}
 }
@@ -252,11 +756,26 @@ func NewGoImapUpdatesNotifier(reader EmailInterface) *GoImapUpdatesNotifier {
 
 type GoImapEmailReader struct {
 	emailInterface EmailInterface
+	renderMode     renderMode
+	keys           messageKeys
+}
+
+func (s *GoImapEmailReader) read(mailbox string, id uint64) string {
+	raw, err := s.emailInterface.readRaw(mailbox, id)
+	if err != nil {
+		return err.Error()
+	}
+	parts, err := parseEmail(raw, s.keys)
+	if err != nil {
+		log.Printf("failed to parse message %d in %s: %v", id, mailbox, err)
+		return "msg parse error"
+	}
+	return string(parts.body(s.renderMode))
 }
 
-func (s *GoImapEmailReader) read(id uint64) string {
-	return s.emailInterface.read(id)
+func (s *GoImapEmailReader) readRaw(mailbox string, id uint64) ([]byte, error) {
+	return s.emailInterface.readRaw(mailbox, id)
 }
-func NewGoImapEmailReader(emailInterface EmailInterface) *GoImapEmailReader {
-	return &GoImapEmailReader{emailInterface}
+func NewGoImapEmailReader(emailInterface EmailInterface, renderMode renderMode, keys messageKeys) *GoImapEmailReader {
+	return &GoImapEmailReader{emailInterface, renderMode, keys}
 }
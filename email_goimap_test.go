@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// Connects to an in-memory server holding the messages in INBOX, with UIDs from 1.
+// The server has only IMAP4rev1 capabilities unless caps are given
+func newMemImap(t *testing.T, caps imap.CapSet, messages ...string) *GoImapEmailInterface {
+	t.Helper()
+	user := imapmemserver.NewUser("user", "pass")
+	user.Create("INBOX", nil)
+	memServer := imapmemserver.New()
+	memServer.AddUser(user)
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+		Caps:         caps,
+		InsecureAuth: true,
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	c, err := imapclient.DialInsecure(ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Login("user", "pass").Wait(); err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range messages {
+		cmd := c.Append("INBOX", int64(len(message)), nil)
+		cmd.Write([]byte(message))
+		cmd.Close()
+		if _, err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &GoImapEmailInterface{c: c}
+}
+
+func TestRenameSelectedMailbox(t *testing.T) {
+	goImap := newMemImap(t, nil, "Subject: report\r\n\r\nbody\r\n")
+	for _, name := range []string{"Work", "Archive"} {
+		if err := goImap.createMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	goImap.selectMailbox("Work")
+
+	// the selection is kept when the server refuses the new name
+	if err := goImap.renameMailbox("Work", "Archive"); err == nil {
+		t.Errorf("Exp renaming to an existing mailbox to fail")
+	}
+	if goImap.selected != "Work" {
+		t.Errorf("Exp Work to stay selected, got %q", goImap.selected)
+	}
+	if err := goImap.renameMailbox("Work", "Job"); err != nil || goImap.selected != "Job" {
+		t.Errorf("Exp Job to be selected, got %q, err %v", goImap.selected, err)
+	}
+}
+
+func serverFlags(t *testing.T, self *GoImapEmailInterface, uid uint64) []imap.Flag {
+	t.Helper()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	msgs, err := self.c.Fetch(imap.UIDSetNum(imap.UID(uid)), &imap.FetchOptions{Flags: true}).Collect()
+	if err != nil || len(msgs) == 0 {
+		t.Fatalf("Fetch of flags failed: %v", err)
+	}
+	return msgs[0].Flags
+}
+
+func TestReadRawKeepsFlags(t *testing.T) {
+	message := "Subject: report\r\n\r\nbody\r\n"
+	goImap := newMemImap(t, nil, message)
+
+	raw, err := goImap.readRaw("INBOX", 1)
+	if err != nil || string(raw) != message {
+		t.Errorf("Exp %q got %q, err %v", message, raw, err)
+	}
+	if flags := serverFlags(t, goImap, 1); slices.Contains(flags, imap.FlagSeen) {
+		t.Errorf("Exp reading the message not to flag it seen, got %v", flags)
+	}
+}
+
+func TestSignatureStatusKeepsFlags(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	signer := newTestEntity(t, "vendor")
+	goImap := newMemImap(t, nil, signedMessage(t, signer, "Content-Type: text/plain\r\n\r\nreport text"))
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{rawEmailReader: goImap, emailFlagger: goImap, emailNotifier: emailNotifier, messageKeys: messageKeys{pgp: openpgp.EntityList{signer}}, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	emailNotifier.mailboxes <- []Mailbox{inbox}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "report", uid: 1, secured: true}
+	fs.Readdir("/INBOX", func(name string, stat *fuse.Stat_t, ofst int64) bool { return true }, 0, 0)
+
+	if errCode, value := fs.Getxattr("/INBOX/report", signatureXattr); errCode != 0 || string(value) != string(signatureValid) {
+		t.Errorf("Exp %q got %q errc %d", signatureValid, value, errCode)
+	}
+	if flags := serverFlags(t, goImap, 1); slices.Contains(flags, imap.FlagSeen) {
+		t.Errorf("Exp the signature attribute not to flag the message seen, got %v", flags)
+	}
+	path := "/INBOX/report" + sigStatusFile
+	// the status file fetches the message again
+	fs.lock.Lock()
+	fs.parsedEmails = newRecentCache[partId, *emailParts](parsedEmailsLimit)
+	fs.lock.Unlock()
+	errCode, fh := fs.Open(path, 0)
+	if errCode != 0 {
+		t.Errorf("Open received %d errc instead of 0", errCode)
+	}
+	fs.Release(path, fh)
+	if flags := serverFlags(t, goImap, 1); slices.Contains(flags, imap.FlagSeen) {
+		t.Errorf("Exp the status file not to flag the message seen, got %v", flags)
+	}
+}
+
+func singlePart(mediaType string, encoding string, size uint32, disposition string, filename string) *imap.BodyStructureSinglePart {
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	part := &imap.BodyStructureSinglePart{Type: typ, Subtype: subtype, Encoding: encoding, Size: size}
+	if disposition != "" {
+		params := map[string]string{}
+		if filename != "" {
+			params["filename"] = filename
+		}
+		part.Extended = &imap.BodyStructureSinglePartExt{Disposition: &imap.BodyStructureDisposition{Value: disposition, Params: params}}
+	} else if filename != "" {
+		part.Params = map[string]string{"name": filename}
+	}
+	return part
+}
+
+func multiPart(subtype string, children ...imap.BodyStructure) *imap.BodyStructureMultiPart {
+	return &imap.BodyStructureMultiPart{Subtype: subtype, Children: children}
+}
+
+func TestBodyAttachments(t *testing.T) {
+	text := singlePart("text/plain", "7bit", 100, "", "")
+	html := singlePart("text/html", "quoted-printable", 300, "", "")
+	tests := []struct {
+		name          string
+		bodyStructure imap.BodyStructure
+		exp           []Attachment
+	}{
+		{
+			name:          "plain text",
+			bodyStructure: text,
+		},
+		{
+			name: "mixed with a base64 attachment",
+			bodyStructure: multiPart("mixed",
+				multiPart("alternative", text, html),
+				singlePart("application/pdf", "base64", 1560, "attachment", "report.pdf"),
+			),
+			exp: []Attachment{{filename: "report.pdf", part: []int{2}, encoding: "base64", size: 1140}},
+		},
+		{
+			name: "inline image and unnamed part",
+			bodyStructure: multiPart("related",
+				html,
+				singlePart("image/png", "base64", 78, "inline", "logo.png"),
+				singlePart("application/octet-stream", "binary", 42, "", ""),
+			),
+			exp: []Attachment{
+				{filename: "logo.png", part: []int{2}, encoding: "base64", size: 57},
+				{part: []int{3}, encoding: "binary", size: 42, exact: true},
+			},
+		},
+		{
+			name: "named by the content type",
+			bodyStructure: multiPart("mixed",
+				text,
+				singlePart("text/plain", "quoted-printable", 20, "attachment", "notes.txt"),
+				singlePart("image/jpeg", "8bit", 10, "", "photo.jpg"),
+			),
+			exp: []Attachment{
+				{filename: "notes.txt", part: []int{2}, encoding: "quoted-printable", size: 20},
+				{filename: "photo.jpg", part: []int{3}, encoding: "8bit", size: 10, exact: true},
+			},
+		},
+		{
+			name: "encrypted",
+			bodyStructure: multiPart("encrypted",
+				singlePart("application/pgp-encrypted", "7bit", 10, "", ""),
+				singlePart("application/octet-stream", "7bit", 500, "inline", "encrypted.asc"),
+			),
+		},
+		{
+			name:          "s/mime",
+			bodyStructure: singlePart("application/pkcs7-mime", "base64", 780, "attachment", "smime.p7m"),
+		},
+	}
+	for _, test := range tests {
+		attachments := bodyAttachments(test.bodyStructure, nil)
+		if !slices.EqualFunc(test.exp, attachments, equalAttachments) {
+			t.Errorf("%s: exp %+v got %+v", test.name, test.exp, attachments)
+		}
+	}
+}
+
+func equalAttachments(a, b Attachment) bool {
+	return a.filename == b.filename && slices.Equal(a.part, b.part) && a.encoding == b.encoding && a.size == b.size &&
+		a.exact == b.exact && a.message == b.message && a.subject == b.subject && slices.EqualFunc(a.parts, b.parts, equalAttachments)
+}
+
+func TestAttachmentSizes(t *testing.T) {
+	pdf := bytes.Repeat([]byte("%PDF binary \x00\xff "), 40)
+	message := "Subject: report\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=report.pdf\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" + string(encodePart(t, "base64", pdf)) +
+		"--b--\r\n"
+	for _, binary := range []bool{false, true} {
+		caps := imap.CapSet{imap.CapIMAP4rev1: {}}
+		if binary {
+			caps[imap.CapBinary] = struct{}{}
+		}
+		goImap := newMemImap(t, caps, message)
+
+		attachments, err := goImap.attachments("INBOX", 1)
+		if err != nil || len(attachments) != 1 {
+			t.Fatalf("Exp one attachment, got %+v, err %v", attachments, err)
+		}
+		attachment := attachments[0]
+		// the exact size is known with BINARY, estimated from the encoded size otherwise
+		if binary && (!attachment.exact || attachment.size != int64(len(pdf))) {
+			t.Errorf("Exp exact size %d got %d exact %t", len(pdf), attachment.size, attachment.exact)
+		}
+		if diff := attachment.size - int64(len(pdf)); !binary && (attachment.exact || diff < -2 || diff > 2) {
+			t.Errorf("Exp estimated size %d got %d exact %t", len(pdf), attachment.size, attachment.exact)
+		}
+		data, err := goImap.readAttachment("INBOX", 1, attachment)
+		if err != nil || !bytes.Equal(data, pdf) {
+			t.Errorf("Exp %q got %q, err %v", pdf, data, err)
+		}
+	}
+}
+
+func attachedMessage(subject string, bodyStructure imap.BodyStructure) *imap.BodyStructureSinglePart {
+	part := singlePart("message/rfc822", "7bit", 1000, "", "")
+	part.MessageRFC822 = &imap.BodyStructureMessageRFC822{Envelope: &imap.Envelope{Subject: subject}, BodyStructure: bodyStructure}
+	return part
+}
+
+func TestAttachedMessageSections(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	text := singlePart("text/plain", "7bit", 100, "", "")
+	bodyStructure := multiPart("mixed",
+		text,
+		// parts of a multipart message are numbered under the part of the message
+		attachedMessage("forwarded", multiPart("mixed",
+			text,
+			singlePart("application/pdf", "binary", 10, "attachment", "invoice.pdf"),
+			attachedMessage("original", multiPart("mixed",
+				text,
+				singlePart("image/png", "binary", 10, "inline", "chart.png"),
+			)),
+		)),
+		// the body of a single-part message is part 1 under it
+		attachedMessage("bounced", singlePart("image/png", "binary", 10, "", "scan.png")),
+	)
+	expSections := map[string]string{
+		"attachments/forwarded":                                            "2",
+		"attachments/forwarded/attachments/invoice.pdf":                    "2.2",
+		"attachments/forwarded/attachments/original":                       "2.3",
+		"attachments/forwarded/attachments/original/attachments/chart.png": "2.3.2",
+		"attachments/bounced":                                              "3",
+		"attachments/bounced/attachments/scan.png":                         "3.1",
+	}
+
+	attachments := bodyAttachments(bodyStructure, nil)
+	paths := make(map[string]Attachment)
+	attachmentPaths("", attachments, paths)
+	sections := make(map[string]string)
+	for path, attachment := range paths {
+		sections[path] = attachment.section()
+	}
+	if !maps.Equal(expSections, sections) {
+		t.Errorf("Exp sections %v got %v", expSections, sections)
+	}
+
+	// files are read by the section of their part
+	attachmentReader := FakeAttachmentReader{list: attachments, data: map[string]string{}}
+	for _, section := range expSections {
+		attachmentReader.data[section] = "contents of " + section
+	}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{attachmentReader: &attachmentReader, emailNotifier: emailNotifier, messageDirs: true, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	emailNotifier.mailboxes <- []Mailbox{inbox}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "report", uid: 1, bodyLen: 100}
+	fs.Readdir("/INBOX", func(name string, stat *fuse.Stat_t, ofst int64) bool { return true }, 0, 0)
+	for path, section := range expSections {
+		if paths[path].message {
+			continue
+		}
+		path = "/INBOX/report/" + path
+		_, fh := fs.Open(path, 0)
+		buf := make([]byte, 100)
+		lenRead := fs.Read(path, buf, 0, fh)
+		if exp := "contents of " + section; string(buf[:lenRead]) != exp {
+			t.Errorf("Read %s exp %q got %q", path, exp, buf[:lenRead])
+		}
+		fs.Release(path, fh)
+	}
+}
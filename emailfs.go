@@ -1,41 +1,237 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	pathpkg "path"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/winfsp/cgofuse/fuse"
 )
 
 type EmailMetadata struct {
-	uid     uint64
+	mailbox   Mailbox
+	uid       uint64
+	messageId string
+	// X-GM-MSGID, the same for the message in all its Gmail labels, zero on other servers
+	gmailId uint64
 	subject string
-	bodyLen int64
+	// name the message is listed under, made from the name template
+	filename     string
+	bodyLen      int64
+	from         EmailAddress
+	to           []EmailAddress
+	cc           []EmailAddress
+	date         time.Time
+	internalDate time.Time
+	// message IDs of earlier messages in the same thread
+	references []string
+	// IMAP flags and keywords, sorted
+	flags []string
+	// when the message was seen to get the \Seen flag, zero if it had it when first listed
+	seenAt time.Time
+	listId string
+	// media types of the inline text parts, telling what reading the message serves
+	bodyTypes []string
+	// the message is signed or encrypted, its signature is checked once it is read
+	secured bool
+}
+
+const emlExt = ".eml"
+
+const (
+	flagSeen    = "\\Seen"
+	flagFlagged = "\\Flagged"
+)
+
+// Flags with a meaning defined by IMAP, other flags are keywords
+var systemFlags = []string{"\\Answered", "\\Deleted", "\\Draft", flagFlagged, flagSeen}
+
+func (m EmailMetadata) hasFlag(flag string) bool {
+	return slices.Contains(m.flags, flag)
+}
+
+// Extension after what reading the message serves: its text, or the calendar of an invitation without text
+func (m EmailMetadata) extension() string {
+	hasText := slices.Contains(m.bodyTypes, "text/plain") || slices.Contains(m.bodyTypes, "text/html")
+	if !hasText && slices.Contains(m.bodyTypes, "text/calendar") {
+		return ".ics"
+	}
+	return ".txt"
+}
+
+// INTERNALDATE, or the Date header when the server did not report it
+func (m EmailMetadata) receivedDate() time.Time {
+	if m.internalDate.IsZero() {
+		return m.date
+	}
+	return m.internalDate
+}
+
+// Identifies copies of the message in several Gmail labels, copies elsewhere can't be told from
+// distinct messages sharing a Message-ID so each one stands alone
+func (m EmailMetadata) copyKey() string {
+	if m.gmailId == 0 {
+		return fmt.Sprintf("%s/%d", m.mailbox.name, m.uid)
+	}
+	return fmt.Sprintf("X-GM-MSGID %d", m.gmailId)
+}
+
+// Links the message to the messages referencing it in a thread
+func (m EmailMetadata) threadKey() string {
+	if m.messageId == "" {
+		return fmt.Sprintf("%s/%d", m.mailbox.name, m.uid)
+	}
+	return m.messageId
+}
+
+type EmailAddress struct {
+	name    string
+	address string
+}
+
+// Identifies a message on the server, UIDs are unique only within a mailbox
+type emailId struct {
+	mailbox string
+	uid     uint64
+}
+
+func (m EmailMetadata) id() emailId {
+	return emailId{mailbox: m.mailbox.name, uid: m.uid}
+}
+
+type Mailbox struct {
+	name     string
+	delim    rune
+	noSelect bool
+	// holds every message of the account, as Gmail's All Mail
+	all bool
+}
+
+// Directory path the mailbox is exposed under, the empty name stands for the root
+func (m Mailbox) path() string {
+	if m.name == "" {
+		return "/"
+	}
+	parts := []string{m.name}
+	if m.delim != 0 {
+		parts = strings.Split(m.name, string(m.delim))
+	}
+	for i, v := range parts {
+		parts[i] = ClearFilename(v)
+	}
+	if slices.Contains(viewNames, parts[0]) {
+		// views own these names at the root
+		parts[0] += mailboxSuffix
+	}
+	return "/" + strings.Join(parts, "/")
 }
 
 type EmailReader interface {
-	read(id uint64) string
+	read(mailbox string, id uint64) string
+}
+
+type RawEmailReader interface {
+	readRaw(mailbox string, id uint64) ([]byte, error)
 }
 
 type EmailRemover interface {
-	remove(id uint64) error
+	remove(mailbox string, id uint64) error
+}
+
+type EmailMover interface {
+	move(mailbox string, id uint64, dest string) (uint64, error)
+}
+
+// Gmail labels are exposed as mailboxes, a message copied to one gets the label
+type EmailLabeler interface {
+	addLabel(mailbox string, id uint64, label string) (uint64, error)
+	removeLabel(mailbox string, id uint64) error
+}
+
+type EmailFlagger interface {
+	// Replaces the flags and keywords of the message
+	setFlags(mailbox string, id uint64, flags []string) error
+}
+
+type EmailSearcher interface {
+	// UIDs of messages in the mailbox matching a query understood by parseSearchQuery
+	search(mailbox string, query string) ([]uint64, error)
+	// Metadata of messages in the mailbox, for matches which are not listed
+	fetch(mailbox string, uids []uint64) ([]EmailMetadata, error)
+}
+
+type GmailSearcher interface {
+	// UIDs of messages in the mailbox matching a query in Gmail's search syntax
+	gmailSearch(mailbox string, query string) ([]uint64, error)
+}
+
+// Returned by deleteMailbox for mailboxes holding messages
+var errMailboxNotEmpty = errors.New("mailbox is not empty")
+
+type MailboxManager interface {
+	createMailbox(name string) error
+	deleteMailbox(name string) error
+	renameMailbox(name string, newName string) error
 }
 
 type EmailUpdatesNotifier interface {
-	notify(knownMessages []EmailMetadata, newMessages chan<- EmailMetadata, removedMessages chan<- EmailMetadata)
+	notify(knownMessages []EmailMetadata, mailboxes chan<- []Mailbox, newMessages chan<- EmailMetadata, removedMessages chan<- EmailMetadata)
 }
 
 type TimerFunc func() <-chan time.Time
 
 type EmailFs struct {
 	fuse.FileSystemBase
-	emailReader         EmailReader
-	emailRemover        EmailRemover
-	emailNotifier       EmailUpdatesNotifier
-	emailsMetadata      map[string]EmailMetadata
-	openFiles           map[uint64]string
-	userId              uint
+	lock             sync.Mutex
+	emailReader      EmailReader
+	rawEmailReader   RawEmailReader
+	attachmentReader AttachmentReader
+	emailRemover     EmailRemover
+	emailMover       EmailMover
+	emailLabeler     EmailLabeler
+	emailFlagger     EmailFlagger
+	mailboxManager   MailboxManager
+	emailSearcher    EmailSearcher
+	gmailSearcher    GmailSearcher
+	emailNotifier    EmailUpdatesNotifier
+	mailboxes        map[string]Mailbox
+	emailsMetadata   map[string]map[string]EmailMetadata
+	// label directories of messages by X-GM-MSGID
+	links map[uint64]int
+	// names messages are listed under in their mailbox directories
+	filenames    map[emailId]string
+	nameTemplate nameTemplate
+	// message files get the extension of what reading them serves
+	extensions  bool
+	virtualDirs map[string]map[string]EmailMetadata
+	// messages matching saved queries, by search root
+	searches map[string]map[string]map[emailId]bool
+	// matches of saved searches which are not listed in their mailbox directories
+	searchedEmails        map[emailId]EmailMetadata
+	searchesFilepath      string
+	gmailSearchesFilepath string
+	viewsDirty            bool
+	openFiles             map[uint64]string
+	// lengths of message text known once it is read, listings report the raw message size before that
+	textSizes   map[emailId]int64
+	nextFh      uint64
+	userId      uint
+	gmailLabels bool
+	// messages are directories of their parts rather than files of their text
+	messageDirs bool
+	// raw messages are listed as .eml files next to message files
+	emlFiles            bool
+	parsedEmails        *recentCache[partId, *emailParts]
+	attachments         *recentCache[emailId, map[string]Attachment]
+	renderMode          renderMode
+	messageKeys         messageKeys
+	mailboxUpdates      chan []Mailbox
 	newMessages         chan EmailMetadata
 	removedMessages     chan EmailMetadata
 	updateIntervalTimer TimerFunc
@@ -43,7 +239,19 @@ type EmailFs struct {
 
 func (self *EmailFs) Init() {
 	self.openFiles = make(map[uint64]string)
-	self.emailsMetadata = make(map[string]EmailMetadata)
+	self.textSizes = make(map[emailId]int64)
+	self.mailboxes = make(map[string]Mailbox)
+	self.emailsMetadata = make(map[string]map[string]EmailMetadata)
+	self.links = make(map[uint64]int)
+	self.filenames = make(map[emailId]string)
+	self.parsedEmails = newRecentCache[partId, *emailParts](parsedEmailsLimit)
+	self.attachments = newRecentCache[emailId, map[string]Attachment](parsedEmailsLimit)
+	self.searches = make(map[string]map[string]map[emailId]bool)
+	self.searchedEmails = make(map[emailId]EmailMetadata)
+	for _, kind := range self.searchKinds() {
+		self.searches[kind.root] = loadSearches(kind.filepath)
+	}
+	self.mailboxUpdates = make(chan []Mailbox, 1)
 	self.newMessages = make(chan EmailMetadata, 500)
 	self.removedMessages = make(chan EmailMetadata, 500)
 
@@ -51,12 +259,22 @@ func (self *EmailFs) Init() {
 		for {
 			// todo refactor
 			var currentMetadata []EmailMetadata
-			for _, v := range self.emailsMetadata {
-				currentMetadata = append(currentMetadata, v)
+			self.lock.Lock()
+			for _, emails := range self.emailsMetadata {
+				for _, v := range emails {
+					currentMetadata = append(currentMetadata, v)
+				}
 			}
-			self.emailNotifier.notify(currentMetadata, self.newMessages, self.removedMessages)
+			self.lock.Unlock()
+			notified := make(chan bool)
+			go self.applyUpdates(notified)
+			self.emailNotifier.notify(currentMetadata, self.mailboxUpdates, self.newMessages, self.removedMessages)
+			close(notified)
+			self.updateSearches()
 			<-self.updateIntervalTimer()
+			self.lock.Lock()
 			self.fetchUpdates()
+			self.lock.Unlock()
 		}
 	}()
 }
@@ -64,52 +282,229 @@ func (self *EmailFs) Init() {
 func (self *EmailFs) Destroy() {}
 
 func (self *EmailFs) Open(path string, flags int) (errc int, fh uint64) {
-	// if match == nil {
-	// 	return -fuse.ENOENT, ^uint64(0)
-	// }
+	errc, fh, _ = self.open(path)
+	return errc, fh
+}
+
+// Opens files whose reported size was an estimate with direct I/O, so the kernel reads them
+// until Read returns nothing rather than up to the reported size
+func (self *EmailFs) OpenEx(path string, fi *fuse.FileInfo_t) int {
+	errc, fh, directIo := self.open(path)
+	fi.Fh = fh
+	fi.DirectIo = directIo
+	return errc
+}
+
+// Reads the file contents into a new handle, reporting whether its size was unknown until now
+func (self *EmailFs) open(path string) (errc int, fh uint64, directIo bool) {
 	log.Printf("Open file %s\n", path)
-	uid := self.emailsMetadata[path].uid
-	body := self.emailReader.read(uid)
-	self.openFiles[uid] = body
-	return 0, uid
+	self.lock.Lock()
+	email, messagePath, inMessageDir := self.lookupMessagePath(path)
+	self.lock.Unlock()
+	if inMessageDir {
+		return self.messageOpen(email, messagePath)
+	}
+
+	self.lock.Lock()
+	email, found := self.lookupFile(path)
+	rawEmail, rawFound := self.lookupRawFile(path)
+	statusEmail, sigStatusFound := self.lookupSigStatusFile(path)
+	self.lock.Unlock()
+	if !found && sigStatusFound {
+		return self.openSigStatus(statusEmail)
+	}
+	if !found && rawFound {
+		raw, err := self.rawEmailReader.readRaw(rawEmail.mailbox.name, rawEmail.uid)
+		if err != nil {
+			log.Printf("Error reading message %d in %s: %v\n", rawEmail.uid, rawEmail.mailbox.name, err)
+			return -fuse.EIO, ^uint64(0), false
+		}
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		self.nextFh++
+		self.openFiles[self.nextFh] = string(raw)
+		return 0, self.nextFh, false
+	}
+	if !found {
+		return -fuse.ENOENT, ^uint64(0), false
+	}
+
+	body := self.emailReader.read(email.mailbox.name, email.uid)
+	self.markSeen(email)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, sizeKnown := self.textSizes[email.id()]
+	self.textSizes[email.id()] = int64(len(body))
+	self.nextFh++
+	self.openFiles[self.nextFh] = body
+	return 0, self.nextFh, !sizeKnown
 }
 
 func (self *EmailFs) Unlink(path string) int {
-	log.Printf("Unlink file %v\n, ", self.emailsMetadata[path])
-	err := self.emailRemover.remove(self.emailsMetadata[path].uid)
+	if self.isVirtual(path) {
+		return -fuse.EROFS
+	}
+	self.lock.Lock()
+	_, messagePath, inMessageDir := self.lookupMessagePath(path)
+	email, found := self.lookupEmail(path)
+	_, rawFound := self.lookupRawFile(path)
+	_, sigStatusFound := self.lookupSigStatusFile(path)
+	self.lock.Unlock()
+	if (inMessageDir && messagePath != "") || (!found && (rawFound || sigStatusFound)) {
+		return -fuse.EROFS
+	}
+	if !found {
+		return -fuse.ENOENT
+	}
+
+	log.Printf("Unlink file %v\n, ", email)
+	var err error
+	if self.gmailLabels && !email.mailbox.all {
+		// only the label is removed, the message stays in other label directories
+		err = self.emailLabeler.removeLabel(email.mailbox.name, email.uid)
+	} else {
+		err = self.emailRemover.remove(email.mailbox.name, email.uid)
+	}
 	if err != nil {
 		log.Printf("Error removing file %s: %v\n", path, err)
 		return -1
 	}
-	delete(self.emailsMetadata, path)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	dir, name := splitPath(path)
+	self.removeEmail(dir, name)
+	return 0
+}
+
+// Adds a Gmail label to the message by linking it into the label directory
+func (self *EmailFs) Link(oldpath string, newpath string) int {
+	log.Printf("Link %s to %s\n", oldpath, newpath)
+	if !self.gmailLabels {
+		return -fuse.ENOSYS
+	}
+	if self.isVirtual(oldpath) || self.isVirtual(newpath) {
+		return -fuse.EROFS
+	}
+	self.lock.Lock()
+	email, label, errc := self.emailLink(oldpath, newpath)
+	self.lock.Unlock()
+	if errc != 0 {
+		return errc
+	}
+
+	uid, err := self.emailLabeler.addLabel(email.mailbox.name, email.uid, label.name)
+	if err != nil {
+		log.Printf("Error linking file %s to %s: %v\n", oldpath, newpath, err)
+		return -fuse.EIO
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	email.mailbox = label
+	email.uid = uid
+	return self.addCopiedEmail(email, newpath)
+}
+
+// Lists the message copied or moved to newpath under the UID the server gave it,
+// failing when it can't be listed there. The caller must hold the lock
+func (self *EmailFs) addCopiedEmail(email EmailMetadata, newpath string) int {
+	if email.uid == 0 {
+		log.Printf("The server did not report the UID of %s, it is listed once fetched\n", newpath)
+		return -fuse.EIO
+	}
+	self.addEmail(email)
+	if _, name := splitPath(newpath); self.filenames[email.id()] != name {
+		log.Printf("Message copied to %s is listed as %s\n", newpath, self.filenames[email.id()])
+		return -fuse.EIO
+	}
+	return 0
+}
+
+// Looks up the message to be linked and the label directory it is linked into, the caller must hold the lock
+func (self *EmailFs) emailLink(oldpath string, newpath string) (EmailMetadata, Mailbox, int) {
+	email, found := self.lookupEmail(oldpath)
+	if !found {
+		return EmailMetadata{}, Mailbox{}, -fuse.ENOENT
+	}
+	newDir, _ := splitPath(newpath)
+	label, found := self.mailboxes[newDir]
+	if !found {
+		return EmailMetadata{}, Mailbox{}, -fuse.ENOENT
+	}
+	if label.noSelect || label.all {
+		return EmailMetadata{}, Mailbox{}, -fuse.EPERM
+	}
+	if errc := self.checkCopyName(email, newpath); errc != 0 {
+		return EmailMetadata{}, Mailbox{}, errc
+	}
+	return email, label, 0
+}
+
+// Filenames come from the name template, so a message copied or moved to another mailbox keeps its name
+// and needs the name to be free there. The caller must hold the lock
+func (self *EmailFs) checkCopyName(email EmailMetadata, newpath string) int {
+	newDir, newName := splitPath(newpath)
+	name := self.messageName(email)
+	if newName != name {
+		return -fuse.EPERM
+	}
+	if _, found := self.emailsMetadata[newDir][name]; found {
+		return -fuse.EEXIST
+	}
 	return 0
 }
 
 func (self *EmailFs) Release(path string, fh uint64) int {
 	log.Printf("Release file %s\n", path)
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	delete(self.openFiles, fh)
 	return 0
 }
 
 func (self *EmailFs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
+	self.lock.Lock()
+	email, messagePath, inMessageDir := self.lookupMessagePath(path)
+	self.lock.Unlock()
+	if inMessageDir {
+		return self.messageGetattr(email, messagePath, stat)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	stat.Uid = uint32(self.userId)
 	stat.Gid = stat.Uid
-	if path == "/" {
-		stat.Mode = fuse.S_IFDIR | 0550
+	if self.isDir(path) {
+		stat.Mode = self.dirMode(path)
+		stat.Ino = emailInode(path)
 		return 0
 	}
 
 	log.Printf("Getattr %s\n", path)
-	stat.Mode = fuse.S_IFREG | 0660
-	stat.Size = int64(self.emailsMetadata[path].bodyLen)
-	stat.Blocks = (stat.Size + 511) / 512
-	return 0
+	if email, found := self.lookupFile(path); found {
+		self.fillEmailStat(email, stat)
+		return 0
+	}
+	if email, found := self.lookupRawFile(path); found {
+		self.fillRawStat(email, stat)
+		return 0
+	}
+	if email, found := self.lookupSigStatusFile(path); found {
+		self.fillSigStatusStat(email, stat)
+		return 0
+	}
+	return -fuse.ENOENT
 }
 
 func (self *EmailFs) Read(path string, buff []byte, ofst int64, fh uint64) int {
 	log.Printf("Read file: %s , handle: %d", path, fh)
-	endofst := ofst + int64(len(buff))
+	self.lock.Lock()
 	contents := self.openFiles[fh]
+	self.lock.Unlock()
+
+	endofst := ofst + int64(len(buff))
 	if endofst > int64(len(contents)) {
 		endofst = int64(len(contents))
 	}
@@ -124,35 +519,777 @@ func (self *EmailFs) Readdir(path string,
 	ofst int64,
 	fh uint64) (errc int) {
 	log.Println("readdir, offs: ", ofst)
-	// fill(".", &fuse.Stat_t{Mode: syscall.S_IFDIR | 0755}, 1)
-	// fill("..", &fuse.Stat_t{Mode: syscall.S_IFDIR | 0755}, 2)
+	self.lock.Lock()
+	email, messagePath, inMessageDir := self.lookupMessagePath(path)
+	self.lock.Unlock()
+	if inMessageDir {
+		return self.messageReaddir(email, messagePath, fill)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
 
 	self.fetchUpdates()
+	if !self.isDir(path) {
+		return -fuse.ENOENT
+	}
 
 	var stat fuse.Stat_t
-	stat.Mode = fuse.S_IFREG | 0660
-	for _, email := range self.emailsMetadata {
-		stat.Size = int64(email.bodyLen)
-		stat.Blocks = (stat.Size + 511) / 512
-		fillOk := fill(email.subject, &stat, 0) //int64(len(self.emailsMetadata)))
+	for _, dirPath := range self.childDirs(path) {
+		_, name := splitPath(dirPath)
+		stat.Mode = self.dirMode(dirPath)
+		stat.Ino = emailInode(dirPath)
+		if !fill(name, &stat, 0) {
+			return 1
+		}
+	}
+
+	emails := self.emailsMetadata[path]
+	if self.isVirtual(path) {
+		emails = self.views()[path]
+	}
+	for name, email := range emails {
+		self.fillEmailStat(email, &stat)
+		fillOk := fill(name, &stat, 0) //int64(len(self.emailsMetadata)))
 		if !fillOk {
 			errc = 1
 			break
 		}
+		if self.hasRawFiles() {
+			// a message named so takes precedence
+			if rawName := self.rawFilename(name, email); !hasKey(emails, rawName) {
+				self.fillRawStat(email, &stat)
+				if !fill(rawName, &stat, 0) {
+					return 1
+				}
+			}
+		}
+		if self.hasSigStatusFile(email) {
+			if statusName := self.companionFilename(name, email, sigStatusFile); !hasKey(emails, statusName) {
+				self.fillSigStatusStat(email, &stat)
+				if !fill(statusName, &stat, 0) {
+					return 1
+				}
+			}
+		}
 	}
 	return
 }
 
+func (self *EmailFs) Getxattr(path string, name string) (int, []byte) {
+	if name == signatureXattr {
+		return self.getSignatureXattr(path)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	dir, _ := splitPath(path)
+	if dir == "/by-sender" && self.isDir(path) && name == "user.email.name" {
+		return 0, []byte(self.senderNames(path))
+	}
+	if email, found := self.lookupXattrFile(path); found {
+		if name == flagsXattr {
+			return 0, []byte(strings.Join(email.flags, " "))
+		}
+		if value := emailXattr(email, name); value != "" {
+			return 0, []byte(value)
+		}
+	}
+	return -fuse.ENOATTR, nil
+}
+
+func (self *EmailFs) Listxattr(path string, fill func(name string) bool) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	dir, _ := splitPath(path)
+	if dir == "/by-sender" && self.isDir(path) {
+		fill("user.email.name")
+	}
+	if email, found := self.lookupXattrFile(path); found {
+		fill(flagsXattr)
+		if email.secured {
+			fill(signatureXattr)
+		}
+		for _, name := range emailXattrNames {
+			if emailXattr(email, name) != "" && !fill(name) {
+				break
+			}
+		}
+	}
+	return 0
+}
+
+// Replaces flags of the message with the space-separated ones set as user.email.flags
+func (self *EmailFs) Setxattr(path string, name string, value []byte, flags int) int {
+	log.Printf("Setxattr %s on %s\n", name, path)
+	self.lock.Lock()
+	email, found := self.lookupXattrFile(path)
+	self.lock.Unlock()
+	if !found {
+		return -fuse.ENOTSUP
+	}
+	if name != flagsXattr {
+		if slices.Contains(emailXattrNames, name) {
+			return -fuse.EPERM
+		}
+		return -fuse.ENOTSUP
+	}
+	emailFlags, err := parseFlags(string(value))
+	if err != nil {
+		log.Printf("Error setting flags of %s: %v\n", path, err)
+		return -fuse.EINVAL
+	}
+	return self.setFlags(email, emailFlags)
+}
+
+// Removing user.email.flags clears flags of the message
+func (self *EmailFs) Removexattr(path string, name string) int {
+	log.Printf("Removexattr %s on %s\n", name, path)
+	self.lock.Lock()
+	email, found := self.lookupXattrFile(path)
+	self.lock.Unlock()
+	if !found {
+		return -fuse.ENOTSUP
+	}
+	if name != flagsXattr {
+		if slices.Contains(emailXattrNames, name) {
+			return -fuse.EPERM
+		}
+		return -fuse.ENOATTR
+	}
+	return self.setFlags(email, nil)
+}
+
+// Stores flags of the message on the server and in its metadata, must be called without the lock held
+func (self *EmailFs) setFlags(email EmailMetadata, flags []string) int {
+	if err := self.emailFlagger.setFlags(email.mailbox.name, email.uid, flags); err != nil {
+		log.Printf("Error setting flags of message %d in %s: %v\n", email.uid, email.mailbox.name, err)
+		return -fuse.EIO
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, labeled := range self.labeledCopies(email) {
+		labeled.flags = flags
+		self.addEmail(labeled)
+	}
+	return 0
+}
+
+// Flags the message seen when its text is opened, as fetching the message is done without marking it.
+// Must be called without the lock held
+func (self *EmailFs) markSeen(email EmailMetadata) {
+	if self.emailFlagger == nil || email.hasFlag(flagSeen) {
+		return
+	}
+	flags := append(slices.Clone(email.flags), flagSeen)
+	slices.Sort(flags)
+	self.setFlags(email, flags)
+}
+
+// The message as currently listed along with, in label mode, its entries in other label directories
+// which share its flags on the server. The caller must hold the lock
+func (self *EmailFs) labeledCopies(email EmailMetadata) []EmailMetadata {
+	var copies []EmailMetadata
+	for _, emails := range self.emailsMetadata {
+		for _, other := range emails {
+			sameLabeled := self.gmailLabels && email.gmailId != 0 && other.gmailId == email.gmailId
+			if other.id() == email.id() || sameLabeled {
+				copies = append(copies, other)
+			}
+		}
+	}
+	return copies
+}
+
+func (self *EmailFs) Mkdir(path string, mode uint32) int {
+	log.Printf("Mkdir %s\n", path)
+	self.lock.Lock()
+	dir, name := splitPath(path)
+	if kind, found := self.searchKind(dir); found {
+		defer self.lock.Unlock()
+		return self.addSearch(kind, name)
+	}
+	mailbox, errc := self.newMailbox(path)
+	self.lock.Unlock()
+	if errc != 0 {
+		return errc
+	}
+
+	if err := self.mailboxManager.createMailbox(mailbox.name); err != nil {
+		log.Printf("Error creating mailbox %s: %v\n", mailbox.name, err)
+		return -fuse.EIO
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.mailboxes[path] = mailbox
+	return 0
+}
+
+// Builds the mailbox to be created for the directory path, the caller must hold the lock
+func (self *EmailFs) newMailbox(path string) (Mailbox, int) {
+	dir, name := splitPath(path)
+	if self.isVirtual(path) {
+		return Mailbox{}, -fuse.EROFS
+	}
+	if _, messagePath, found := self.lookupMessagePath(path); found && messagePath != "" {
+		return Mailbox{}, -fuse.EROFS
+	}
+	if !self.isDir(dir) {
+		return Mailbox{}, -fuse.ENOENT
+	}
+	if _, found := self.lookupEmail(path); found || self.isDir(path) {
+		return Mailbox{}, -fuse.EEXIST
+	}
+	return self.childMailbox(dir, name), 0
+}
+
+func (self *EmailFs) Rmdir(path string) int {
+	log.Printf("Rmdir %s\n", path)
+	self.lock.Lock()
+	_, messagePath, inMessageDir := self.lookupMessagePath(path)
+	self.lock.Unlock()
+	if inMessageDir {
+		if messagePath != "" {
+			return -fuse.EROFS
+		}
+		// a message directory is removed along with the message although it is not empty,
+		// its files are read-only so it could not be emptied first
+		return self.Unlink(path)
+	}
+
+	self.lock.Lock()
+	dir, name := splitPath(path)
+	if kind, found := self.searchKind(dir); found {
+		defer self.lock.Unlock()
+		return self.removeSearch(kind, name)
+	}
+	mailbox, errc := self.emptyMailbox(path)
+	self.lock.Unlock()
+	if errc != 0 {
+		return errc
+	}
+
+	// only the last messages of a mailbox are listed, the server tells whether it is empty
+	err := self.mailboxManager.deleteMailbox(mailbox.name)
+	if errors.Is(err, errMailboxNotEmpty) {
+		return -fuse.ENOTEMPTY
+	} else if err != nil {
+		log.Printf("Error deleting mailbox %s: %v\n", mailbox.name, err)
+		return -fuse.EIO
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.mailboxes, path)
+	delete(self.emailsMetadata, path)
+	return 0
+}
+
+// Looks up the mailbox of the directory path to be deleted, the caller must hold the lock
+func (self *EmailFs) emptyMailbox(path string) (Mailbox, int) {
+	if self.isVirtual(path) {
+		return Mailbox{}, -fuse.EROFS
+	}
+	mailbox, found := self.mailboxes[path]
+	if !found {
+		return Mailbox{}, -fuse.ENOENT
+	}
+	if len(self.emailsMetadata[path]) > 0 || self.hasChildMailboxes(path) {
+		return Mailbox{}, -fuse.ENOTEMPTY
+	}
+	return mailbox, 0
+}
+
+func (self *EmailFs) Rename(oldpath string, newpath string) int {
+	log.Printf("Rename %s to %s\n", oldpath, newpath)
+	if self.isVirtual(oldpath) || self.isVirtual(newpath) {
+		return -fuse.EROFS
+	}
+	self.lock.Lock()
+	_, messagePath, inMessageDir := self.lookupMessagePath(oldpath)
+	_, isMailbox := self.mailboxes[oldpath]
+	self.lock.Unlock()
+	if inMessageDir && messagePath != "" {
+		return -fuse.EROFS
+	}
+	if isMailbox {
+		return self.renameMailbox(oldpath, newpath)
+	}
+	return self.moveEmail(oldpath, newpath)
+}
+
+// Moves the message under oldpath to the mailbox newpath is in, must be called without the lock held
+func (self *EmailFs) moveEmail(oldpath string, newpath string) int {
+	self.lock.Lock()
+	email, dest, errc := self.emailMove(oldpath, newpath)
+	self.lock.Unlock()
+	if errc != 0 {
+		return errc
+	}
+
+	uid, err := self.emailMover.move(email.mailbox.name, email.uid, dest.name)
+	if err != nil {
+		log.Printf("Error moving file %s to %s: %v\n", oldpath, newpath, err)
+		return -fuse.EIO
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if filename, found := self.filenames[email.id()]; found {
+		self.removeEmail(email.mailbox.path(), filename)
+	}
+	email.mailbox = dest
+	email.uid = uid
+	return self.addCopiedEmail(email, newpath)
+}
+
+// Looks up the message to be moved and the mailbox it is moved to, the caller must hold the lock
+func (self *EmailFs) emailMove(oldpath string, newpath string) (EmailMetadata, Mailbox, int) {
+	email, found := self.lookupEmail(oldpath)
+	if !found {
+		return EmailMetadata{}, Mailbox{}, -fuse.ENOENT
+	}
+	oldDir, _ := splitPath(oldpath)
+	newDir, _ := splitPath(newpath)
+	dest, found := self.mailboxes[newDir]
+	if !found {
+		return EmailMetadata{}, Mailbox{}, -fuse.ENOENT
+	}
+	// filenames come from the name template, so messages can change mailbox but not name
+	if newDir == oldDir || dest.noSelect {
+		return EmailMetadata{}, Mailbox{}, -fuse.EPERM
+	}
+	if errc := self.checkCopyName(email, newpath); errc != 0 {
+		return EmailMetadata{}, Mailbox{}, errc
+	}
+	return email, dest, 0
+}
+
+// Renames the mailbox under oldpath along with its children, must be called without the lock held
+func (self *EmailFs) renameMailbox(oldpath string, newpath string) int {
+	self.lock.Lock()
+	mailbox, renamed, errc := self.mailboxRename(oldpath, newpath)
+	self.lock.Unlock()
+	if errc != 0 {
+		return errc
+	}
+	if err := self.mailboxManager.renameMailbox(mailbox.name, renamed.name); err != nil {
+		log.Printf("Error renaming mailbox %s to %s: %v\n", mailbox.name, renamed.name, err)
+		return -fuse.EIO
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// the server renames child mailboxes too
+	for path, child := range self.mailboxes {
+		if path != oldpath && !strings.HasPrefix(path, oldpath+"/") {
+			continue
+		}
+		child.name = renamed.name + strings.TrimPrefix(child.name, mailbox.name)
+		child.delim = renamed.delim
+		delete(self.mailboxes, path)
+		self.mailboxes[child.path()] = child
+
+		emails := self.emailsMetadata[path]
+		delete(self.emailsMetadata, path)
+		for filename, email := range emails {
+			delete(self.filenames, email.id())
+			email.mailbox = child
+			emails[filename] = email
+			self.filenames[email.id()] = filename
+		}
+		if emails != nil {
+			self.emailsMetadata[child.path()] = emails
+		}
+	}
+	self.viewsDirty = true
+	return 0
+}
+
+// Looks up the mailbox under oldpath and builds the one it is renamed to, the caller must hold the lock
+func (self *EmailFs) mailboxRename(oldpath string, newpath string) (Mailbox, Mailbox, int) {
+	dir, name := splitPath(newpath)
+	if !self.isDir(dir) {
+		return Mailbox{}, Mailbox{}, -fuse.ENOENT
+	}
+	if _, found := self.lookupEmail(newpath); found || self.isDir(newpath) {
+		return Mailbox{}, Mailbox{}, -fuse.EEXIST
+	}
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return Mailbox{}, Mailbox{}, -fuse.EINVAL
+	}
+	return self.mailboxes[oldpath], self.childMailbox(dir, name), 0
+}
+
+// Builds the mailbox to be exposed as a directory with the given name under dir
+func (self *EmailFs) childMailbox(dir string, name string) Mailbox {
+	parent := self.mailboxes[dir]
+	delim := parent.delim
+	if delim == 0 {
+		delim = '/'
+		for _, v := range self.mailboxes {
+			if v.delim != 0 {
+				delim = v.delim
+				break
+			}
+		}
+	}
+	if dir == "/" {
+		return Mailbox{name: name, delim: delim}
+	}
+	return Mailbox{name: parent.name + string(delim) + name, delim: delim}
+}
+
+func (self *EmailFs) hasChildMailboxes(path string) bool {
+	for dirPath := range self.mailboxes {
+		if parent, _ := splitPath(dirPath); parent == path && dirPath != "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// Paths of mailbox and virtual directories directly under path
+func (self *EmailFs) childDirs(path string) []string {
+	var dirs []string
+	for dirPath := range self.mailboxes {
+		if parent, _ := splitPath(dirPath); parent == path && dirPath != "/" && !self.isVirtual(dirPath) {
+			dirs = append(dirs, dirPath)
+		}
+	}
+	for dirPath := range self.views() {
+		if parent, _ := splitPath(dirPath); parent == path {
+			dirs = append(dirs, dirPath)
+		}
+	}
+	return dirs
+}
+
+// Applies pending updates from the notifier, the caller must hold the lock
 func (self *EmailFs) fetchUpdates() {
 	for more := true; more; {
 		select {
+		case mailboxes := <-self.mailboxUpdates:
+			self.setMailboxes(mailboxes)
 		case email := <-self.newMessages:
-			email.subject = ClearFilename(email.subject)
-			self.emailsMetadata[fmt.Sprintf("/%s", email.subject)] = email
+			self.addEmail(email)
 		case email := <-self.removedMessages:
-			delete(self.emailsMetadata, fmt.Sprintf("/%s", email.subject))
+			self.removeUpdatedEmail(email)
 		default:
 			more = false
 		}
 	}
 }
+
+// Applies updates as the notifier sends them until notified is closed,
+// so the notifier never waits for a Readdir when it sends more than the channels hold
+func (self *EmailFs) applyUpdates(notified <-chan bool) {
+	for {
+		select {
+		case mailboxes := <-self.mailboxUpdates:
+			self.lock.Lock()
+			self.setMailboxes(mailboxes)
+		case email := <-self.newMessages:
+			self.lock.Lock()
+			self.addEmail(email)
+		case email := <-self.removedMessages:
+			self.lock.Lock()
+			self.removeUpdatedEmail(email)
+		case <-notified:
+			return
+		}
+		self.fetchUpdates()
+		self.lock.Unlock()
+	}
+}
+
+func (self *EmailFs) removeUpdatedEmail(email EmailMetadata) {
+	// names of removed messages may have changed since, UIDs don't
+	if filename, found := self.filenames[email.id()]; found {
+		self.removeEmail(email.mailbox.path(), filename)
+	}
+}
+
+// Adds the message under the name made from the name template, replacing its earlier entry. Messages sharing a name
+// are told apart by UIDs: the one with the lowest UID keeps the name, so names don't change as new mail arrives
+func (self *EmailFs) addEmail(email EmailMetadata) {
+	dir := email.mailbox.path()
+	if self.emailsMetadata[dir] == nil {
+		self.emailsMetadata[dir] = make(map[string]EmailMetadata)
+	}
+	name := self.messageName(email)
+	if filename, found := self.filenames[email.id()]; found {
+		old, _ := self.takeEmail(dir, filename)
+		if oldName := self.messageName(old); oldName != name {
+			self.promoteEmail(dir, oldName)
+		}
+		if email.hasFlag(flagSeen) && old.hasFlag(flagSeen) {
+			email.seenAt = old.seenAt
+		} else if email.hasFlag(flagSeen) {
+			email.seenAt = time.Now()
+		}
+	}
+
+	email.filename = name
+	if owner, found := self.emailsMetadata[dir][name]; found {
+		if owner.uid < email.uid {
+			email.filename = self.uniqueFilename(dir, email)
+		} else {
+			self.takeEmail(dir, name)
+			owner.filename = self.uniqueFilename(dir, owner)
+			self.putEmail(dir, owner)
+		}
+	}
+	self.putEmail(dir, email)
+}
+
+// Name of the message made from the name template, with the extension of what reading it serves
+// unless extensions are off or messages are directories
+func (self *EmailFs) messageName(email EmailMetadata) string {
+	name := self.nameTemplate.name(email)
+	ext := email.extension()
+	if !self.extensions || self.messageDirs || strings.HasSuffix(name, ext) {
+		return name
+	}
+	return ClearFilenameWithSuffix(name, ext)
+}
+
+// Removes the message listed under the name, a message sharing its name takes it over
+func (self *EmailFs) removeEmail(dir string, name string) {
+	if email, found := self.takeEmail(dir, name); found {
+		delete(self.textSizes, email.id())
+		self.promoteEmail(dir, self.messageName(email))
+	}
+}
+
+func (self *EmailFs) putEmail(dir string, email EmailMetadata) {
+	self.emailsMetadata[dir][email.filename] = email
+	self.filenames[email.id()] = email.filename
+	self.viewsDirty = true
+	if email.gmailId != 0 {
+		self.links[email.gmailId]++
+	}
+}
+
+func (self *EmailFs) takeEmail(dir string, name string) (EmailMetadata, bool) {
+	email, found := self.emailsMetadata[dir][name]
+	if found {
+		self.unlinkEmail(email)
+		delete(self.filenames, email.id())
+		delete(self.emailsMetadata[dir], name)
+		self.viewsDirty = true
+	}
+	return email, found
+}
+
+// Gives the name to the message with the lowest UID among those named so by the template, if it is free
+func (self *EmailFs) promoteEmail(dir string, name string) {
+	if _, found := self.emailsMetadata[dir][name]; found {
+		return
+	}
+	var first *EmailMetadata
+	for _, email := range self.emailsMetadata[dir] {
+		if self.messageName(email) == name && (first == nil || email.uid < first.uid) {
+			first = &email
+		}
+	}
+	if first != nil {
+		email, _ := self.takeEmail(dir, first.filename)
+		email.filename = name
+		self.putEmail(dir, email)
+	}
+}
+
+// Name of a message whose template name is taken, suffixed with its UID.
+// UIDs are unique in a mailbox, so the attempts don't run out
+func (self *EmailFs) uniqueFilename(dir string, email EmailMetadata) string {
+	name, _ := uidFilename(self.messageName(email), email.uid, func(name string) bool {
+		owner, found := self.emailsMetadata[dir][name]
+		return found && owner.id() != email.id()
+	})
+	return name
+}
+
+func (self *EmailFs) unlinkEmail(email EmailMetadata) {
+	if email.gmailId == 0 {
+		return
+	}
+	self.links[email.gmailId]--
+	if self.links[email.gmailId] <= 0 {
+		delete(self.links, email.gmailId)
+	}
+}
+
+func (self *EmailFs) fillEmailStat(email EmailMetadata, stat *fuse.Stat_t) {
+	if self.messageDirs {
+		self.messageDirStat(email, "", stat)
+		return
+	}
+	fillEmailTimes(email, stat)
+	stat.Mode = fuse.S_IFREG | 0660
+	stat.Size = int64(email.bodyLen)
+	if size, found := self.textSizes[email.id()]; found {
+		stat.Size = size
+	}
+	stat.Blocks = (stat.Size + 511) / 512
+	stat.Nlink = 1
+	stat.Ino = emailInode(fmt.Sprintf("%s/%d", email.mailbox.name, email.uid))
+	if self.gmailLabels && email.gmailId != 0 {
+		// a message with several labels is the same file in every label directory
+		stat.Nlink = uint32(max(self.links[email.gmailId], 1))
+		stat.Ino = emailInode(fmt.Sprintf("X-GM-MSGID %d", email.gmailId))
+	}
+}
+
+// mtime is when the server received the message and birth time the Date header. As in mail spools,
+// atime precedes mtime until the message is seen
+func fillEmailTimes(email EmailMetadata, stat *fuse.Stat_t) {
+	stat.Atim, stat.Mtim, stat.Ctim, stat.Birthtim = fuse.Timespec{}, fuse.Timespec{}, fuse.Timespec{}, fuse.Timespec{}
+	received := email.receivedDate()
+	if received.IsZero() {
+		return
+	}
+	stat.Mtim = fuse.NewTimespec(received)
+	stat.Ctim = stat.Mtim
+	stat.Birthtim = stat.Mtim
+	if !email.date.IsZero() {
+		stat.Birthtim = fuse.NewTimespec(email.date)
+	}
+	switch {
+	case !email.hasFlag(flagSeen):
+		stat.Atim = fuse.NewTimespec(received.Add(-time.Second))
+	case email.seenAt.After(received):
+		stat.Atim = fuse.NewTimespec(email.seenAt)
+	default:
+		stat.Atim = stat.Mtim
+	}
+}
+
+// Raw messages are listed next to message files, message directories hold them inside
+func (self *EmailFs) hasRawFiles() bool {
+	return self.emlFiles && !self.messageDirs
+}
+
+// Name of the raw variant of the message file listed under name, the .eml extension replaces the extension of the file
+func (self *EmailFs) rawFilename(name string, email EmailMetadata) string {
+	return self.companionFilename(name, email, emlExt)
+}
+
+// Name of a file listed next to the message file under name, the extension replaces the extension of the file
+func (self *EmailFs) companionFilename(name string, email EmailMetadata, ext string) string {
+	if self.extensions {
+		name = strings.TrimSuffix(name, email.extension())
+	}
+	return name + ext
+}
+
+// Looks up the raw variant of a message file, named after the message with the .eml extension.
+// The caller must hold the lock
+func (self *EmailFs) lookupRawFile(path string) (EmailMetadata, bool) {
+	if !self.hasRawFiles() {
+		return EmailMetadata{}, false
+	}
+	return self.lookupCompanionFile(path, emlExt)
+}
+
+// Looks up the message a file named after it with the extension is listed next to, the caller must hold the lock
+func (self *EmailFs) lookupCompanionFile(path string, ext string) (EmailMetadata, bool) {
+	name, found := strings.CutSuffix(path, ext)
+	if !found {
+		return EmailMetadata{}, false
+	}
+	if !self.extensions {
+		return self.lookupFile(name)
+	}
+	for _, ext := range []string{".txt", ".ics"} {
+		if email, found := self.lookupFile(name + ext); found && email.extension() == ext {
+			return email, true
+		}
+	}
+	return EmailMetadata{}, false
+}
+
+// Size of a raw message is known from RFC822.SIZE without fetching it
+func (self *EmailFs) fillRawStat(email EmailMetadata, stat *fuse.Stat_t) {
+	self.fillEmailStat(email, stat)
+	stat.Mode = fuse.S_IFREG | 0440
+	stat.Size = email.bodyLen
+	stat.Blocks = (stat.Size + 511) / 512
+	stat.Ino = emailInode(fmt.Sprintf("%d%s", stat.Ino, emlExt))
+}
+
+// Replaces known mailboxes with the given ones, adding directories for parents missing on the server
+func (self *EmailFs) setMailboxes(mailboxes []Mailbox) {
+	self.mailboxes = make(map[string]Mailbox)
+	for _, mailbox := range mailboxes {
+		self.mailboxes[mailbox.path()] = mailbox
+	}
+	for _, mailbox := range mailboxes {
+		if mailbox.delim == 0 {
+			continue
+		}
+		parts := strings.Split(mailbox.name, string(mailbox.delim))
+		for i := 1; i < len(parts); i++ {
+			parent := Mailbox{name: strings.Join(parts[:i], string(mailbox.delim)), delim: mailbox.delim, noSelect: true}
+			if _, known := self.mailboxes[parent.path()]; !known {
+				self.mailboxes[parent.path()] = parent
+			}
+		}
+	}
+	for dir, emails := range self.emailsMetadata {
+		if _, known := self.mailboxes[dir]; !known && dir != "/" {
+			for name := range emails {
+				self.removeEmail(dir, name)
+			}
+			delete(self.emailsMetadata, dir)
+		}
+	}
+}
+
+func (self *EmailFs) isDir(path string) bool {
+	if self.isVirtual(path) {
+		_, found := self.views()[path]
+		return found
+	}
+	_, found := self.mailboxes[path]
+	return path == "/" || found
+}
+
+// Looks up a message file in a mailbox directory
+func (self *EmailFs) lookupEmail(path string) (EmailMetadata, bool) {
+	dir, name := splitPath(path)
+	email, found := self.emailsMetadata[dir][name]
+	return email, found
+}
+
+// Looks up a message file in either a mailbox or a virtual directory
+func (self *EmailFs) lookupFile(path string) (EmailMetadata, bool) {
+	if !self.isVirtual(path) {
+		return self.lookupEmail(path)
+	}
+	dir, name := splitPath(path)
+	email, found := self.views()[dir][name]
+	return email, found
+}
+
+func (self *EmailFs) dirMode(path string) uint32 {
+	// saved searches are added and removed with mkdir and rmdir
+	if _, found := self.searchKind(path); found {
+		return fuse.S_IFDIR | 0770
+	}
+	if self.isVirtual(path) {
+		return fuse.S_IFDIR | 0550
+	}
+	return fuse.S_IFDIR | 0770
+}
+
+func emailInode(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return hash.Sum64()
+}
+
+func splitPath(path string) (dir string, name string) {
+	return pathpkg.Dir(path), pathpkg.Base(path)
+}
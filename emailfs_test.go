@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"maps"
 	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,16 +14,21 @@ import (
 
 type FakeUpdatesNotifier struct {
 	metadata         []EmailMetadata
+	mailboxes        chan<- []Mailbox
 	newMessages      chan<- EmailMetadata
 	removedMessages  chan<- EmailMetadata
 	knownMessages    []EmailMetadata
 	notifyCalledChan chan bool
 }
 
-func (s *FakeUpdatesNotifier) notify(knownMessages []EmailMetadata, newMessages chan<- EmailMetadata, removedMessages chan<- EmailMetadata) {
+func (s *FakeUpdatesNotifier) notify(knownMessages []EmailMetadata, mailboxes chan<- []Mailbox, newMessages chan<- EmailMetadata, removedMessages chan<- EmailMetadata) {
+	s.mailboxes = mailboxes
 	s.newMessages = newMessages
 	s.removedMessages = removedMessages
 	s.knownMessages = knownMessages
+	for _, v := range s.metadata {
+		newMessages <- v
+	}
 	s.notifyCalledChan <- true
 }
 
@@ -30,17 +38,36 @@ func NewFakeUpdatesNotifier() *FakeUpdatesNotifier {
 
 type FakeEmailReader struct {
 	body string
+	raw  string
 }
 
-func (s *FakeEmailReader) read(id uint64) string {
+func (s *FakeEmailReader) read(mailbox string, id uint64) string {
 	return s.body
 }
 
+func (s *FakeEmailReader) readRaw(mailbox string, id uint64) ([]byte, error) {
+	return []byte(s.raw), nil
+}
+
+type FakeAttachmentReader struct {
+	list []Attachment
+	// attachment contents by section
+	data map[string]string
+}
+
+func (s *FakeAttachmentReader) attachments(mailbox string, id uint64) ([]Attachment, error) {
+	return s.list, nil
+}
+
+func (s *FakeAttachmentReader) readAttachment(mailbox string, id uint64, attachment Attachment) ([]byte, error) {
+	return []byte(s.data[attachment.section()]), nil
+}
+
 type FakeEmailRemover struct {
 	retErr error
 }
 
-func (s *FakeEmailRemover) remove(id uint64) error {
+func (s *FakeEmailRemover) remove(mailbox string, id uint64) error {
 	return s.retErr
 }
 
@@ -48,6 +75,105 @@ func NewFakeEmailRemover(retErr error) *FakeEmailRemover {
 	return &FakeEmailRemover{retErr: retErr}
 }
 
+type FakeEmailMover struct {
+	newUid uint64
+	retErr error
+}
+
+func (s *FakeEmailMover) move(mailbox string, id uint64, dest string) (uint64, error) {
+	return s.newUid, s.retErr
+}
+
+func NewFakeEmailMover(newUid uint64, retErr error) *FakeEmailMover {
+	return &FakeEmailMover{newUid: newUid, retErr: retErr}
+}
+
+type FakeEmailLabeler struct {
+	// UID of the copy reported in COPYUID, 0 for none
+	copyUid uint64
+	calls   []string
+}
+
+func (s *FakeEmailLabeler) addLabel(mailbox string, id uint64, label string) (uint64, error) {
+	s.calls = append(s.calls, fmt.Sprintf("add %s %d %s", mailbox, id, label))
+	return s.copyUid, nil
+}
+
+func (s *FakeEmailLabeler) removeLabel(mailbox string, id uint64) error {
+	s.calls = append(s.calls, fmt.Sprintf("remove %s %d", mailbox, id))
+	return nil
+}
+
+type FakeEmailFlagger struct {
+	calls []string
+}
+
+func (s *FakeEmailFlagger) setFlags(mailbox string, id uint64, flags []string) error {
+	s.calls = append(s.calls, fmt.Sprintf("%s %d %s", mailbox, id, strings.Join(flags, " ")))
+	return nil
+}
+
+type FakeEmailSearcher struct {
+	lock    sync.Mutex
+	results map[string][]uint64
+	fetched []uint64
+}
+
+func (s *FakeEmailSearcher) search(mailbox string, query string) ([]uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.results[mailbox], nil
+}
+
+func (s *FakeEmailSearcher) fetch(mailbox string, uids []uint64) ([]EmailMetadata, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fetched = append(s.fetched, uids...)
+	var emails []EmailMetadata
+	for _, uid := range uids {
+		emails = append(emails, EmailMetadata{uid: uid, subject: fmt.Sprintf("older %d", uid), bodyLen: 1})
+	}
+	return emails, nil
+}
+
+func (s *FakeEmailSearcher) setResults(results map[string][]uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.results = results
+}
+
+type FakeGmailSearcher struct {
+	results map[string][]uint64
+}
+
+func (s *FakeGmailSearcher) gmailSearch(mailbox string, query string) ([]uint64, error) {
+	return s.results[mailbox], nil
+}
+
+type FakeMailboxManager struct {
+	calls  []string
+	retErr error
+}
+
+func (s *FakeMailboxManager) createMailbox(name string) error {
+	s.calls = append(s.calls, "create "+name)
+	return s.retErr
+}
+
+func (s *FakeMailboxManager) deleteMailbox(name string) error {
+	s.calls = append(s.calls, "delete "+name)
+	return s.retErr
+}
+
+func (s *FakeMailboxManager) renameMailbox(name string, newName string) error {
+	s.calls = append(s.calls, "rename "+name+" "+newName)
+	return s.retErr
+}
+
+func NewFakeMailboxManager(retErr error) *FakeMailboxManager {
+	return &FakeMailboxManager{retErr: retErr}
+}
+
 func TestReaddir(t *testing.T) {
 	var subjects []string
 	for i := 0; i < 100; i++ {
@@ -62,11 +188,14 @@ func TestReaddir(t *testing.T) {
 
 	var dirItems []string
 	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if stat.Mode&fuse.S_IFMT == fuse.S_IFDIR {
+			return true
+		}
 		dirItems = append(dirItems, name)
 		return true
 	}
-	for _, v := range subjects {
-		emailNotifier.newMessages <- EmailMetadata{subject: v}
+	for i, v := range subjects {
+		emailNotifier.newMessages <- EmailMetadata{subject: v, uid: uint64(i)}
 	}
 
 	fs.Readdir("/", fill, 0, 0)
@@ -129,6 +258,406 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestNameTemplateRenames(t *testing.T) {
+	template, _ := parseNameTemplate("[{flags}] {subject}")
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailNotifier: emailNotifier, nameTemplate: template, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if stat.Mode&fuse.S_IFMT != fuse.S_IFDIR {
+			dirItems = append(dirItems, name)
+		}
+		return true
+	}
+	emailNotifier.newMessages <- EmailMetadata{subject: "report", uid: 1}
+	emailNotifier.newMessages <- EmailMetadata{subject: "notes", uid: 2}
+	// flags changed on the server
+	emailNotifier.newMessages <- EmailMetadata{subject: "report", uid: 1, flags: []string{flagSeen}}
+	fs.Readdir("/", fill, 0, 0)
+	if exp := []string{"[Seen] report", "[] notes"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+
+	emailNotifier.removedMessages <- EmailMetadata{subject: "report", uid: 1, flags: []string{flagSeen}}
+	dirItems = nil
+	fs.Readdir("/", fill, 0, 0)
+	if exp := []string{"[] notes"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	template, _ := parseNameTemplate("{subject}.txt")
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailNotifier: emailNotifier, nameTemplate: template, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	emailNotifier.mailboxes <- []Mailbox{inbox}
+	for _, uid := range []uint64{5, 3, 9} {
+		emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "Your order has shipped", uid: uid, messageId: fmt.Sprint(uid)}
+	}
+	checkNames := func(exp map[string]uint64) {
+		t.Helper()
+		for _, dir := range []string{"/INBOX", "/unread"} {
+			dirItems = nil
+			fs.Readdir(dir, fill, 0, 0)
+			if !checkSubjectsMatch(slices.Collect(maps.Keys(exp)), dirItems) {
+				t.Errorf("Readdir %s exp %v got %s", dir, slices.Collect(maps.Keys(exp)), dirItems)
+			}
+		}
+		for name, uid := range exp {
+			fs.lock.Lock()
+			email, found := fs.lookupEmail("/INBOX/" + name)
+			fs.lock.Unlock()
+			if !found || email.uid != uid {
+				t.Errorf("Exp %s to be message %d, got %d", name, uid, email.uid)
+			}
+		}
+	}
+	// the name doesn't depend on the order messages arrive in
+	checkNames(map[string]uint64{
+		"Your order has shipped.txt":     3,
+		"Your order has shipped (5).txt": 5,
+		"Your order has shipped (9).txt": 9,
+	})
+
+	// removal matches the UID, the message with the next UID takes the name over
+	emailNotifier.removedMessages <- EmailMetadata{mailbox: inbox, subject: "Your order has shipped", uid: 3}
+	checkNames(map[string]uint64{
+		"Your order has shipped.txt":     5,
+		"Your order has shipped (9).txt": 9,
+	})
+}
+
+func TestTimestamps(t *testing.T) {
+	sent := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	received := sent.Add(time.Minute)
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		return true
+	}
+	emailNotifier.newMessages <- EmailMetadata{subject: "new", uid: 1, date: sent, internalDate: received}
+	emailNotifier.newMessages <- EmailMetadata{subject: "read", uid: 2, date: sent, internalDate: received, flags: []string{flagSeen}}
+	fs.Readdir("/", fill, 0, 0)
+
+	var stat fuse.Stat_t
+	fs.Getattr("/new", &stat, 0)
+	if !stat.Mtim.Time().Equal(received) || !stat.Birthtim.Time().Equal(sent) {
+		t.Errorf("Exp mtime %v and birth time %v, got %v and %v", received, sent, stat.Mtim.Time(), stat.Birthtim.Time())
+	}
+	if !stat.Atim.Time().Before(received) {
+		t.Errorf("Exp atime of an unread message before mtime, got %v", stat.Atim.Time())
+	}
+	fs.Getattr("/read", &stat, 0)
+	if !stat.Atim.Time().Equal(received) {
+		t.Errorf("Exp atime of a read message to be mtime, got %v", stat.Atim.Time())
+	}
+
+	// read elsewhere
+	before := time.Now()
+	emailNotifier.newMessages <- EmailMetadata{subject: "new", uid: 1, date: sent, internalDate: received, flags: []string{flagSeen}}
+	fs.Readdir("/", fill, 0, 0)
+	if fs.Getattr("/new", &stat, 0); stat.Atim.Time().Before(before.Truncate(time.Second)) {
+		t.Errorf("Exp atime of the time the message was seen, got %v", stat.Atim.Time())
+	}
+}
+
+func TestFileSize(t *testing.T) {
+	body := "text of a much longer raw message"
+	testMetadata := EmailMetadata{subject: "report", uid: 1, bodyLen: 1000}
+	emailReader := FakeEmailReader{body: body}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailReader: &emailReader, emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		return true
+	}
+	emailNotifier.newMessages <- testMetadata
+	fs.Readdir("/", fill, 0, 0)
+
+	var stat fuse.Stat_t
+	if fs.Getattr("/report", &stat, 0); stat.Size != testMetadata.bodyLen {
+		t.Errorf("Exp raw size %d before reading got %d", testMetadata.bodyLen, stat.Size)
+	}
+	// the estimated size must not cut reads short
+	var fi fuse.FileInfo_t
+	if errCode := fs.OpenEx("/report", &fi); errCode != 0 || !fi.DirectIo {
+		t.Errorf("Exp direct I/O for the first open, got %t errc %d", fi.DirectIo, errCode)
+	}
+	fs.Release("/report", fi.Fh)
+	if fs.Getattr("/report", &stat, 0); stat.Size != int64(len(body)) {
+		t.Errorf("Exp text size %d after reading got %d", len(body), stat.Size)
+	}
+	if fs.OpenEx("/report", &fi); fi.DirectIo {
+		t.Errorf("Exp page cache once the size is known")
+	}
+	fs.Release("/report", fi.Fh)
+}
+
+func TestMessageDirs(t *testing.T) {
+	raw := strings.ReplaceAll(`From: Alice <alice@example.com>
+Subject: report
+Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain
+
+plain body
+--inner
+Content-Type: text/html
+
+<p>html body</p>
+--inner--
+--outer--
+`, "\n", "\r\n")
+	attachedRaw := "Subject: draft\r\n\r\nattached body"
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	emailReader := FakeEmailReader{raw: raw}
+	attachmentReader := FakeAttachmentReader{
+		list: []Attachment{
+			{filename: "report.pdf", part: []int{2}, size: 3, exact: true},
+			{filename: "report.pdf", part: []int{3}, size: 12},
+			{message: true, subject: "draft", part: []int{4}, parts: []Attachment{
+				{filename: "notes.txt", part: []int{4, 2}, size: 5, exact: true},
+			}},
+		},
+		data: map[string]string{"2": "pdf", "3": "second pdf", "4": attachedRaw, "4.2": "notes"},
+	}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{rawEmailReader: &emailReader, attachmentReader: &attachmentReader, emailNotifier: emailNotifier, messageDirs: true, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	emailNotifier.mailboxes <- []Mailbox{inbox}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "report", uid: 1, bodyLen: int64(len(raw))}
+	fs.Readdir("/INBOX", fill, 0, 0)
+
+	var stat fuse.Stat_t
+	if errCode := fs.Getattr("/INBOX/report", &stat, 0); errCode != 0 || stat.Mode&fuse.S_IFMT != fuse.S_IFDIR {
+		t.Errorf("Exp message directory, got mode %o errc %d", stat.Mode, errCode)
+	}
+	expDirItems := map[string][]string{
+		"/INBOX/report":             {"body.txt", "body.html", "headers", "raw.eml", "attachments"},
+		"/INBOX/report/attachments": {"report.pdf", "report (2).pdf", "draft"},
+		// attached messages are directories like the message itself
+		"/INBOX/report/attachments/draft":             {"body.txt", "headers", "raw.eml", "attachments"},
+		"/INBOX/report/attachments/draft/attachments": {"notes.txt"},
+	}
+	for path, exp := range expDirItems {
+		dirItems = nil
+		fs.Readdir(path, fill, 0, 0)
+		if !checkSubjectsMatch(exp, dirItems) {
+			t.Errorf("Readdir %s exp %s got %s", path, exp, dirItems)
+		}
+	}
+
+	expContents := map[string]string{
+		"/INBOX/report/body.txt":                                "plain body",
+		"/INBOX/report/body.html":                               "<p>html body</p>",
+		"/INBOX/report/raw.eml":                                 raw,
+		"/INBOX/report/attachments/report.pdf":                  "pdf",
+		"/INBOX/report/attachments/draft/body.txt":              "attached body",
+		"/INBOX/report/attachments/draft/raw.eml":               attachedRaw,
+		"/INBOX/report/attachments/draft/attachments/notes.txt": "notes",
+	}
+	for path, exp := range expContents {
+		if errCode := fs.Getattr(path, &stat, 0); errCode != 0 || stat.Size != int64(len(exp)) {
+			t.Errorf("Getattr %s exp size %d got %d, errc %d", path, len(exp), stat.Size, errCode)
+		}
+		_, fh := fs.Open(path, 0)
+		buf := make([]byte, 1000)
+		lenRead := fs.Read(path, buf, 0, fh)
+		if string(buf[:lenRead]) != exp {
+			t.Errorf("Read %s exp %q got %q", path, exp, buf[:lenRead])
+		}
+		fs.Release(path, fh)
+	}
+
+	// an estimated size is replaced by the actual one once the attachment is read
+	path := "/INBOX/report/attachments/report (2).pdf"
+	if fs.Getattr(path, &stat, 0); stat.Size != 12 {
+		t.Errorf("Exp estimated size 12 got %d", stat.Size)
+	}
+	_, fh := fs.Open(path, 0)
+	fs.Release(path, fh)
+	if fs.Getattr(path, &stat, 0); stat.Size != int64(len("second pdf")) {
+		t.Errorf("Exp size %d after reading got %d", len("second pdf"), stat.Size)
+	}
+
+	if errCode := fs.Unlink("/INBOX/report/body.txt"); errCode != -fuse.EROFS {
+		t.Errorf("Unlink received %d errc instead of EROFS", errCode)
+	}
+	if errCode := fs.Getattr("/INBOX/report/missing", &stat, 0); errCode != -fuse.ENOENT {
+		t.Errorf("Getattr received %d errc instead of ENOENT", errCode)
+	}
+}
+
+func TestOpeningTextMarksSeen(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	raw := "Subject: report\r\n\r\nbody"
+	for _, messageDirs := range []bool{false, true} {
+		emailReader := FakeEmailReader{body: "body", raw: raw}
+		emailFlagger := FakeEmailFlagger{}
+		emailNotifier := NewFakeUpdatesNotifier()
+		fs := EmailFs{emailReader: &emailReader, rawEmailReader: &emailReader, attachmentReader: &FakeAttachmentReader{}, emailFlagger: &emailFlagger, emailNotifier: emailNotifier, messageDirs: messageDirs, emlFiles: !messageDirs, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+		fs.Init()
+
+		<-emailNotifier.notifyCalledChan
+
+		fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+			return true
+		}
+		emailNotifier.mailboxes <- []Mailbox{inbox}
+		emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "report", uid: 1, bodyLen: int64(len(raw))}
+		fs.Readdir("/INBOX", fill, 0, 0)
+
+		paths := []string{"/INBOX/report.eml"}
+		text := "/INBOX/report"
+		if messageDirs {
+			fs.Readdir("/INBOX/report", fill, 0, 0)
+			paths = []string{"/INBOX/report/headers", "/INBOX/report/raw.eml"}
+			text = "/INBOX/report/body.txt"
+		}
+		var stat fuse.Stat_t
+		fs.Getattr(text, &stat, 0)
+		for _, path := range paths {
+			_, fh := fs.Open(path, 0)
+			fs.Release(path, fh)
+		}
+		if len(emailFlagger.calls) != 0 {
+			t.Errorf("Exp flags unchanged before the text is opened, got %s", emailFlagger.calls)
+		}
+
+		_, fh := fs.Open(text, 0)
+		fs.Release(text, fh)
+		if exp := []string{"INBOX 1 \\Seen"}; !slices.Equal(exp, emailFlagger.calls) {
+			t.Errorf("Exp %s got %s", exp, emailFlagger.calls)
+		}
+		// a seen message isn't flagged again
+		_, fh = fs.Open(text, 0)
+		fs.Release(text, fh)
+		if len(emailFlagger.calls) != 1 {
+			t.Errorf("Exp one call got %s", emailFlagger.calls)
+		}
+	}
+}
+
+func TestEmlFiles(t *testing.T) {
+	raw := "Subject: report\r\n\r\nbody"
+	emailReader := FakeEmailReader{body: "body", raw: raw}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailReader: &emailReader, rawEmailReader: &emailReader, emailNotifier: emailNotifier, emlFiles: true, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if stat.Mode&fuse.S_IFREG != 0 {
+			dirItems = append(dirItems, name)
+		}
+		return true
+	}
+	emailNotifier.newMessages <- EmailMetadata{subject: "report", uid: 1, bodyLen: int64(len(raw))}
+	emailNotifier.newMessages <- EmailMetadata{subject: "notes.eml", uid: 2, bodyLen: 10}
+	fs.Readdir("/", fill, 0, 0)
+	if exp := []string{"report", "report.eml", "notes.eml", "notes.eml.eml"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+
+	var stat fuse.Stat_t
+	if errCode := fs.Getattr("/report.eml", &stat, 0); errCode != 0 || stat.Size != int64(len(raw)) {
+		t.Errorf("Exp size %d got %d, errc %d", len(raw), stat.Size, errCode)
+	}
+	expContents := map[string]string{"/report": "body", "/report.eml": raw, "/notes.eml": "body"}
+	for path, exp := range expContents {
+		_, fh := fs.Open(path, 0)
+		buf := make([]byte, 99)
+		lenRead := fs.Read(path, buf, 0, fh)
+		if string(buf[:lenRead]) != exp {
+			t.Errorf("Read %s exp %q got %q", path, exp, buf[:lenRead])
+		}
+	}
+	if errCode := fs.Unlink("/report.eml"); errCode != -fuse.EROFS {
+		t.Errorf("Unlink received %d errc instead of EROFS", errCode)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	raw := "Subject: invite\r\n\r\nbody"
+	emailReader := FakeEmailReader{body: "body", raw: raw}
+	emailNotifier := NewFakeUpdatesNotifier()
+	emailRemover := NewFakeEmailRemover(nil)
+	fs := EmailFs{emailReader: &emailReader, rawEmailReader: &emailReader, emailRemover: emailRemover, emailNotifier: emailNotifier, emlFiles: true, extensions: true, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if stat.Mode&fuse.S_IFREG != 0 {
+			dirItems = append(dirItems, name)
+		}
+		return true
+	}
+	emailNotifier.newMessages <- EmailMetadata{subject: "report", uid: 1, bodyTypes: []string{"text/plain"}}
+	emailNotifier.newMessages <- EmailMetadata{subject: "report", uid: 2, bodyTypes: []string{"text/html", "text/calendar"}}
+	emailNotifier.newMessages <- EmailMetadata{subject: "invite", uid: 3, bodyTypes: []string{"text/calendar"}}
+	emailNotifier.newMessages <- EmailMetadata{subject: "notes.txt", uid: 4}
+	fs.Readdir("/", fill, 0, 0)
+	exp := []string{"report.txt", "report.eml", "report (2).txt", "report (2).eml", "invite.ics", "invite.eml", "notes.txt", "notes.eml"}
+	if !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+
+	expContents := map[string]string{"/invite.ics": "body", "/invite.eml": raw, "/report (2).eml": raw}
+	for path, exp := range expContents {
+		_, fh := fs.Open(path, 0)
+		buf := make([]byte, 99)
+		lenRead := fs.Read(path, buf, 0, fh)
+		if string(buf[:lenRead]) != exp {
+			t.Errorf("Read %s exp %q got %q", path, exp, buf[:lenRead])
+		}
+	}
+	if errCode := fs.Unlink("/report (2).txt"); errCode != 0 {
+		t.Errorf("Unlink received %d errc", errCode)
+	}
+	dirItems = nil
+	fs.Readdir("/", fill, 0, 0)
+	if exp := []string{"report.txt", "report.eml", "invite.ics", "invite.eml", "notes.txt", "notes.eml"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+}
+
 func TestReaddirIncludesEmailUpdates(t *testing.T) {
 	var testSubjects []string
 	for i := 0; i < 100; i++ {
@@ -147,11 +676,14 @@ func TestReaddirIncludesEmailUpdates(t *testing.T) {
 
 	var listedDirItems []string
 	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if stat.Mode&fuse.S_IFMT == fuse.S_IFDIR {
+			return true
+		}
 		listedDirItems = append(listedDirItems, name)
 		return true
 	}
-	for _, v := range testSubjects {
-		emailNotifier.newMessages <- EmailMetadata{subject: v}
+	for i, v := range testSubjects {
+		emailNotifier.newMessages <- EmailMetadata{subject: v, uid: uint64(i)}
 	}
 	fs.Readdir("/", fill, 0, 0)
 
@@ -167,7 +699,7 @@ func TestReaddirIncludesEmailUpdates(t *testing.T) {
 
 	listedDirItems = []string{}
 	addedEmailSubhect := "new email"
-	emailNotifier.newMessages <- EmailMetadata{subject: addedEmailSubhect}
+	emailNotifier.newMessages <- EmailMetadata{subject: addedEmailSubhect, uid: 100}
 	testSubjects = append(testSubjects, addedEmailSubhect)
 	fs.Readdir("/", fill, 0, 0)
 
@@ -202,11 +734,38 @@ func TestEmailUpdatesArePeriodicallyFetched(t *testing.T) {
 		}
 
 		testSubjects = append(testSubjects, fmt.Sprintf("email subject %d", i))
-		emailNotifier.newMessages <- EmailMetadata{subject: testSubjects[i]}
+		emailNotifier.newMessages <- EmailMetadata{subject: testSubjects[i], uid: uint64(i)}
 		updateIntervalTick <- time.Now()
 	}
 }
 
+func TestUpdatesAreAppliedWhileNotifying(t *testing.T) {
+	emailNotifier := NewFakeUpdatesNotifier()
+	// more messages than the channel holds
+	for i := range 8 {
+		mailbox := Mailbox{name: fmt.Sprintf("mailbox%d", i), delim: '/'}
+		for uid := range 100 {
+			emailNotifier.metadata = append(emailNotifier.metadata, EmailMetadata{mailbox: mailbox, subject: fmt.Sprintf("email subject %d", uid), uid: uint64(uid + 1), bodyLen: 1})
+		}
+	}
+	fs := EmailFs{emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	select {
+	case <-emailNotifier.notifyCalledChan:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Timeout waiting for notify to send all messages")
+	}
+	var stat fuse.Stat_t
+	errc := -fuse.ENOENT
+	for deadline := time.Now().Add(time.Second); errc != 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		errc = fs.Getattr("/mailbox7/email subject 99", &stat, 0)
+	}
+	if errc != 0 {
+		t.Errorf("Getattr of the last message exp 0 got %d", errc)
+	}
+}
+
 func TestEmailRemoval(t *testing.T) {
 	emailRemover := NewFakeEmailRemover(nil)
 	emailNotifier := NewFakeUpdatesNotifier()
@@ -218,6 +777,9 @@ func TestEmailRemoval(t *testing.T) {
 
 	var dirItems []string
 	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if stat.Mode&fuse.S_IFMT == fuse.S_IFDIR {
+			return true
+		}
 		dirItems = append(dirItems, name)
 		return true
 	}
@@ -244,10 +806,756 @@ func TestEmailRemoval(t *testing.T) {
 	}
 }
 
-func checkSubjectsMatch(submittedSubjects []string, listedSubjects []string) bool {
-	slices.Sort(submittedSubjects)
-	slices.Sort(listedSubjects)
-	return slices.Compare(submittedSubjects, listedSubjects) == 0
+func TestMailboxesAreListedAsDirectories(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	acme := Mailbox{name: "Work/Clients/Acme", delim: '/'}
+	body := "acme body"
+
+	emailReader := FakeEmailReader{body: body}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailReader: &emailReader, emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	emailNotifier.mailboxes <- []Mailbox{inbox, acme}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "inbox email", uid: 1}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: acme, subject: "acme email", uid: 1, bodyLen: int64(len(body))}
+
+	expDirItems := map[string][]string{
+		"/":                  append([]string{"INBOX", "Work"}, virtualRootNames()...),
+		"/INBOX":             {"inbox email"},
+		"/Work":              {"Clients"},
+		"/Work/Clients":      {"Acme"},
+		"/Work/Clients/Acme": {"acme email"},
+	}
+	for path, exp := range expDirItems {
+		dirItems = nil
+		if errCode := fs.Readdir(path, fill, 0, 0); errCode != 0 {
+			t.Errorf("Readdir %s received %d errc instead of 0", path, errCode)
+		}
+		if !checkSubjectsMatch(exp, dirItems) {
+			t.Errorf("Readdir %s exp %s got %s", path, exp, dirItems)
+		}
+
+		var stat fuse.Stat_t
+		fs.Getattr(path, &stat, 0)
+		if stat.Mode&fuse.S_IFMT != fuse.S_IFDIR {
+			t.Errorf("Exp %s to be a directory, got mode %o", path, stat.Mode)
+		}
+	}
+
+	filename := "/Work/Clients/Acme/acme email"
+	var stat fuse.Stat_t
+	if errCode := fs.Getattr(filename, &stat, 0); errCode != 0 || stat.Mode&fuse.S_IFMT != fuse.S_IFREG {
+		t.Errorf("Exp %s to be a file, got errc %d mode %o", filename, errCode, stat.Mode)
+	}
+	if errCode := fs.Getattr("/Work/acme email", &stat, 0); errCode != -fuse.ENOENT {
+		t.Errorf("Received %d errc instead of ENOENT", errCode)
+	}
+
+	_, fh := fs.Open(filename, 0)
+	buf := make([]byte, 99)
+	lenRead := fs.Read(filename, buf, 0, fh)
+	if string(buf[:lenRead]) != body {
+		t.Errorf("Exp %s got %s", body, string(buf[:lenRead]))
+	}
+}
+
+func TestMailboxManagement(t *testing.T) {
+	mailboxManager := NewFakeMailboxManager(nil)
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{mailboxManager: mailboxManager, emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	work := Mailbox{name: "Work", delim: '.'}
+	emailNotifier.mailboxes <- []Mailbox{{name: "INBOX", delim: '.'}, work}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: work, subject: "work email", uid: 1}
+	fs.Readdir("/", fill, 0, 0)
+
+	if errCode := fs.Mkdir("/Work/Clients", 0770); errCode != 0 {
+		t.Errorf("Mkdir received %d errc instead of 0", errCode)
+	}
+	if errCode := fs.Mkdir("/Work/Clients", 0770); errCode != -fuse.EEXIST {
+		t.Errorf("Mkdir received %d errc instead of EEXIST", errCode)
+	}
+	if errCode := fs.Rename("/Work", "/Job"); errCode != 0 {
+		t.Errorf("Rename received %d errc instead of 0", errCode)
+	}
+	if errCode := fs.Rmdir("/Job"); errCode != -fuse.ENOTEMPTY {
+		t.Errorf("Rmdir received %d errc instead of ENOTEMPTY", errCode)
+	}
+	if errCode := fs.Rmdir("/Job/Clients"); errCode != 0 {
+		t.Errorf("Rmdir received %d errc instead of 0", errCode)
+	}
+	if exp := []string{"create Work.Clients", "rename Work Job", "delete Job.Clients"}; slices.Compare(exp, mailboxManager.calls) != 0 {
+		t.Errorf("Exp calls %s got %s", exp, mailboxManager.calls)
+	}
+
+	// messages not listed locally are known to the server
+	fs.Mkdir("/Archive", 0770)
+	mailboxManager.retErr = errMailboxNotEmpty
+	if errCode := fs.Rmdir("/Archive"); errCode != -fuse.ENOTEMPTY {
+		t.Errorf("Rmdir received %d errc instead of ENOTEMPTY", errCode)
+	}
+	mailboxManager.retErr = nil
+	mailboxManager.calls = nil
+
+	dirItems = nil
+	fs.Readdir("/", fill, 0, 0)
+	if exp := append([]string{"INBOX", "Job", "Archive"}, virtualRootNames()...); !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+	dirItems = nil
+	fs.Readdir("/Job", fill, 0, 0)
+	if exp := []string{"work email"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+}
+
+func TestEmailMove(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	archive := Mailbox{name: "Archive", delim: '/'}
+	emailMover := NewFakeEmailMover(42, nil)
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailMover: emailMover, emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	emailNotifier.mailboxes <- []Mailbox{inbox, archive}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "email 1", uid: 1}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "email 2", uid: 2}
+	fs.Readdir("/INBOX", fill, 0, 0)
+
+	if errCode := fs.Rename("/INBOX/email 1", "/INBOX/renamed"); errCode != -fuse.EPERM {
+		t.Errorf("Received %d errc instead of EPERM", errCode)
+	}
+	// the moved message keeps its name
+	if errCode := fs.Rename("/INBOX/email 1", "/Archive/renamed"); errCode != -fuse.EPERM {
+		t.Errorf("Received %d errc instead of EPERM", errCode)
+	}
+	if errCode := fs.Rename("/INBOX/email 1", "/Archive/email 2"); errCode != -fuse.EPERM {
+		t.Errorf("Received %d errc instead of EPERM", errCode)
+	}
+	if email, found := fs.lookupEmail("/INBOX/email 1"); !found || email.uid != 1 {
+		t.Errorf("Exp email 1 to stay in INBOX")
+	}
+	if errCode := fs.Rename("/INBOX/email 1", "/Archive/email 1"); errCode != 0 {
+		t.Errorf("Received %d errc instead of 0", errCode)
+	}
+
+	dirItems = nil
+	fs.Readdir("/INBOX", fill, 0, 0)
+	if exp := []string{"email 2"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+	dirItems = nil
+	fs.Readdir("/Archive", fill, 0, 0)
+	if exp := []string{"email 1"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+	if email, _ := fs.lookupEmail("/Archive/email 1"); email.id() != (emailId{mailbox: "Archive", uid: 42}) {
+		t.Errorf("Exp moved email to have Archive UID 42, got %v", email.id())
+	}
+
+	// a message of the same name in the mailbox would get another name
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "email 1", uid: 3}
+	fs.Readdir("/INBOX", fill, 0, 0)
+	if errCode := fs.Rename("/INBOX/email 1", "/Archive/email 1"); errCode != -fuse.EEXIST {
+		t.Errorf("Received %d errc instead of EEXIST", errCode)
+	}
+	emailNotifier.removedMessages <- EmailMetadata{mailbox: inbox, subject: "email 1", uid: 3}
+	fs.Readdir("/INBOX", fill, 0, 0)
+
+	// without COPYUID the moved message is left for the notifier to list
+	emailMover.newUid = 0
+	if errCode := fs.Rename("/INBOX/email 2", "/Archive/email 2"); errCode != -fuse.EIO {
+		t.Errorf("Received %d errc instead of EIO", errCode)
+	}
+	dirItems = nil
+	fs.Readdir("/INBOX", fill, 0, 0)
+	if len(dirItems) != 0 {
+		t.Errorf("Exp no emails got %s", dirItems)
+	}
+	dirItems = nil
+	fs.Readdir("/Archive", fill, 0, 0)
+	if exp := []string{"email 1"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+}
+
+func TestGmailLabelsAreHardLinks(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	work := Mailbox{name: "Work", delim: '/'}
+	later := Mailbox{name: "Later", delim: '/'}
+	allMail := Mailbox{name: "[Gmail]/All Mail", delim: '/', all: true}
+	emailLabeler := &FakeEmailLabeler{copyUid: 7}
+	emailRemover := NewFakeEmailRemover(nil)
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailLabeler: emailLabeler, emailRemover: emailRemover, emailFlagger: &FakeEmailFlagger{}, emailNotifier: emailNotifier, gmailLabels: true, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		return true
+	}
+	emailNotifier.mailboxes <- []Mailbox{inbox, work, later, allMail}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "labeled", gmailId: 1001, uid: 1}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: work, subject: "labeled", gmailId: 1001, uid: 2}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: allMail, subject: "labeled", gmailId: 1001, uid: 3}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "other", gmailId: 1002, uid: 4}
+	fs.Readdir("/", fill, 0, 0)
+
+	checkLinks := func(path string, expNlink uint32) fuse.Stat_t {
+		var stat fuse.Stat_t
+		if errCode := fs.Getattr(path, &stat, 0); errCode != 0 {
+			t.Errorf("Getattr %s received %d errc instead of 0", path, errCode)
+		}
+		if stat.Nlink != expNlink {
+			t.Errorf("Exp %s nlink %d got %d", path, expNlink, stat.Nlink)
+		}
+		return stat
+	}
+	inboxStat := checkLinks("/INBOX/labeled", 3)
+	workStat := checkLinks("/Work/labeled", 3)
+	otherStat := checkLinks("/INBOX/other", 1)
+	if inboxStat.Ino != workStat.Ino || inboxStat.Ino == otherStat.Ino {
+		t.Errorf("Exp labeled message to share an inode, got %d %d, other %d", inboxStat.Ino, workStat.Ino, otherStat.Ino)
+	}
+
+	// views list a message with several labels once
+	var dirItems []string
+	fs.Readdir("/unread", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}, 0, 0)
+	if exp := []string{"labeled", "other"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Readdir /unread exp %s got %s", exp, dirItems)
+	}
+
+	if errCode := fs.Link("/INBOX/labeled", "/Later/labeled"); errCode != 0 {
+		t.Errorf("Link received %d errc instead of 0", errCode)
+	}
+	checkLinks("/Later/labeled", 4)
+
+	if errCode := fs.Unlink("/Work/labeled"); errCode != 0 {
+		t.Errorf("Unlink received %d errc instead of 0", errCode)
+	}
+	checkLinks("/INBOX/labeled", 3)
+
+	if exp := []string{"add INBOX 1 Later", "remove Work 2"}; slices.Compare(exp, emailLabeler.calls) != 0 {
+		t.Errorf("Exp calls %s got %s", exp, emailLabeler.calls)
+	}
+
+	// the link must be listed under the name it was made with
+	emailNotifier.newMessages <- EmailMetadata{mailbox: later, subject: "other", gmailId: 1003, uid: 9}
+	fs.Readdir("/Later", fill, 0, 0)
+	if errCode := fs.Link("/INBOX/other", "/Work/renamed"); errCode != -fuse.EPERM {
+		t.Errorf("Link received %d errc instead of EPERM", errCode)
+	}
+	if errCode := fs.Link("/INBOX/other", "/Later/other"); errCode != -fuse.EEXIST {
+		t.Errorf("Link received %d errc instead of EEXIST", errCode)
+	}
+	if len(emailLabeler.calls) != 2 {
+		t.Errorf("Exp no labels added, got calls %s", emailLabeler.calls)
+	}
+	// without COPYUID the link can't be listed until the message is fetched
+	emailLabeler.copyUid = 0
+	if errCode := fs.Link("/INBOX/other", "/Work/other"); errCode != -fuse.EIO {
+		t.Errorf("Link received %d errc instead of EIO", errCode)
+	}
+	var stat fuse.Stat_t
+	if errCode := fs.Getattr("/Work/other", &stat, 0); errCode != -fuse.ENOENT {
+		t.Errorf("Getattr received %d errc instead of ENOENT", errCode)
+	}
+
+	// Gmail keeps flags per message, so they change in every label directory
+	if errCode := fs.Setxattr("/INBOX/labeled", flagsXattr, []byte(flagFlagged), 0); errCode != 0 {
+		t.Errorf("Setxattr received %d errc", errCode)
+	}
+	for _, path := range []string{"/INBOX/labeled", "/Later/labeled", "/[Gmail]/All Mail/labeled"} {
+		if errCode, value := fs.Getxattr(path, flagsXattr); errCode != 0 || string(value) != flagFlagged {
+			t.Errorf("Exp %s flags %q got %q errc %d", path, flagFlagged, value, errCode)
+		}
+	}
+	if errCode, value := fs.Getxattr("/INBOX/other", flagsXattr); errCode != 0 || len(value) != 0 {
+		t.Errorf("Exp other message to keep no flags, got %q errc %d", value, errCode)
+	}
+}
+
+func TestByDateView(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	received := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	sent := time.Date(2025, 1, 2, 12, 0, 0, 0, time.Local)
+	emailNotifier.mailboxes <- []Mailbox{inbox}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "received", uid: 1, internalDate: received, date: sent}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "sent", uid: 2, date: sent}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "undated", uid: 3}
+
+	expDirItems := map[string][]string{
+		"/by-date":            {"2025", "2026"},
+		"/by-date/2026":       {"10"},
+		"/by-date/2026/10":    {"17"},
+		"/by-date/2026/10/17": {"received"},
+		"/by-date/2025/01/02": {"sent"},
+	}
+	for path, exp := range expDirItems {
+		dirItems = nil
+		if errCode := fs.Readdir(path, fill, 0, 0); errCode != 0 {
+			t.Errorf("Readdir %s received %d errc instead of 0", path, errCode)
+		}
+		if !checkSubjectsMatch(exp, dirItems) {
+			t.Errorf("Readdir %s exp %s got %s", path, exp, dirItems)
+		}
+	}
+
+	if errCode := fs.Unlink("/by-date/2026/10/17/received"); errCode != -fuse.EROFS {
+		t.Errorf("Received %d errc instead of EROFS", errCode)
+	}
+
+	emailNotifier.removedMessages <- EmailMetadata{mailbox: inbox, subject: "sent", uid: 2}
+	dirItems = nil
+	fs.Readdir("/by-date", fill, 0, 0)
+	if exp := []string{"2026"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+}
+
+func TestBySenderView(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	customer := EmailAddress{name: "Jane Customer", address: "Customer@x.com"}
+	emailNotifier.mailboxes <- []Mailbox{inbox}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "question", uid: 1, from: customer}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "follow-up", uid: 2, from: EmailAddress{address: "customer@x.com"}}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "newsletter", uid: 3, from: EmailAddress{name: "News", address: "news@y.com"}}
+
+	// distinct messages sharing a name and a Message-ID are both listed, named as in mailboxes
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "question", uid: 4, from: customer, messageId: "1@x"}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "question", uid: 5, from: customer, messageId: "1@x"}
+
+	expDirItems := map[string][]string{
+		"/by-sender":                {"customer@x.com", "news@y.com"},
+		"/by-sender/customer@x.com": {"question", "follow-up", "question (4)", "question (5)"},
+		"/INBOX":                    {"question", "follow-up", "newsletter", "question (4)", "question (5)"},
+	}
+	for path, exp := range expDirItems {
+		dirItems = nil
+		fs.Readdir(path, fill, 0, 0)
+		if !checkSubjectsMatch(exp, dirItems) {
+			t.Errorf("Readdir %s exp %s got %s", path, exp, dirItems)
+		}
+	}
+
+	errCode, name := fs.Getxattr("/by-sender/customer@x.com", "user.email.name")
+	if errCode != 0 || string(name) != customer.name {
+		t.Errorf("Exp display name %s got %s, errc %d", customer.name, name, errCode)
+	}
+	if errCode, _ := fs.Getxattr("/by-sender/customer@x.com", "user.unknown"); errCode != -fuse.ENOATTR {
+		t.Errorf("Received %d errc instead of ENOATTR", errCode)
+	}
+}
+
+func TestMessageXattrs(t *testing.T) {
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		return true
+	}
+	emailNotifier.newMessages <- EmailMetadata{
+		subject:   "release",
+		uid:       1,
+		messageId: "1@x.com",
+		from:      EmailAddress{name: "Jane", address: "jane@x.com"},
+		to:        []EmailAddress{{address: "dev@lists.x.com"}, {name: "Bob", address: "bob@y.com"}},
+		date:      time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC),
+		listId:    "Developers <dev.lists.x.com>",
+		flags:     []string{flagSeen},
+	}
+	fs.Readdir("/", fill, 0, 0)
+
+	expXattrs := map[string]string{
+		"user.email.flags":      `\Seen`,
+		"user.email.from":       "Jane <jane@x.com>",
+		"user.email.to":         "dev@lists.x.com, Bob <bob@y.com>",
+		"user.email.date":       "2026-01-02T10:00:00Z",
+		"user.email.message-id": "1@x.com",
+		"user.email.list-id":    "Developers <dev.lists.x.com>",
+	}
+	var names []string
+	fs.Listxattr("/release", func(name string) bool {
+		names = append(names, name)
+		return true
+	})
+	if !checkSubjectsMatch(slices.Collect(maps.Keys(expXattrs)), names) {
+		t.Errorf("Exp attributes %v got %v", slices.Collect(maps.Keys(expXattrs)), names)
+	}
+	for name, exp := range expXattrs {
+		if errCode, value := fs.Getxattr("/release", name); errCode != 0 || string(value) != exp {
+			t.Errorf("Getxattr %s exp %q got %q, errc %d", name, exp, value, errCode)
+		}
+	}
+	if errCode, _ := fs.Getxattr("/release", "user.email.cc"); errCode != -fuse.ENOATTR {
+		t.Errorf("Received %d errc instead of ENOATTR", errCode)
+	}
+}
+
+func TestFlagsXattr(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	emailFlagger := FakeEmailFlagger{}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailFlagger: &emailFlagger, emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	emailNotifier.mailboxes <- []Mailbox{inbox}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "invoice", uid: 4, flags: []string{flagSeen}}
+	fs.Readdir("/INBOX", fill, 0, 0)
+
+	if errCode := fs.Setxattr("/INBOX/invoice", flagsXattr, []byte(`\Seen \Flagged $Important`), 0); errCode != 0 {
+		t.Errorf("Setxattr received %d errc", errCode)
+	}
+	if exp := []string{`INBOX 4 $Important \Flagged \Seen`}; !slices.Equal(exp, emailFlagger.calls) {
+		t.Errorf("Exp calls %s got %s", exp, emailFlagger.calls)
+	}
+	if errCode, value := fs.Getxattr("/INBOX/invoice", flagsXattr); errCode != 0 || string(value) != `$Important \Flagged \Seen` {
+		t.Errorf("Exp flags to read back, got %q errc %d", value, errCode)
+	}
+	dirItems = nil
+	fs.Readdir("/flagged", fill, 0, 0)
+	if exp := []string{"invoice"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Readdir /flagged exp %s got %s", exp, dirItems)
+	}
+
+	errCodes := map[string]int{
+		`\Unknown`:    -fuse.EINVAL,
+		"bad(flag)":   -fuse.EINVAL,
+		"ünicode":     -fuse.EINVAL,
+		`$Work \Seen`: 0,
+	}
+	for value, exp := range errCodes {
+		if errCode := fs.Setxattr("/INBOX/invoice", flagsXattr, []byte(value), 0); errCode != exp {
+			t.Errorf("Setxattr %q exp errc %d got %d", value, exp, errCode)
+		}
+	}
+	if errCode := fs.Setxattr("/INBOX/invoice", "user.email.from", []byte("x@y.com"), 0); errCode != -fuse.EPERM {
+		t.Errorf("Received %d errc instead of EPERM", errCode)
+	}
+	if errCode := fs.Removexattr("/INBOX/invoice", flagsXattr); errCode != 0 {
+		t.Errorf("Removexattr received %d errc", errCode)
+	}
+	if errCode, value := fs.Getxattr("/INBOX/invoice", flagsXattr); errCode != 0 || len(value) != 0 {
+		t.Errorf("Exp no flags after removing them, got %q errc %d", value, errCode)
+	}
+}
+
+func TestThreadsView(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	sent := Mailbox{name: "Sent", delim: '/'}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	day := func(d int) time.Time {
+		return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC)
+	}
+	emailNotifier.mailboxes <- []Mailbox{inbox, sent}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "X", messageId: "1@x", uid: 1, internalDate: day(1)}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: sent, subject: "Re: X", messageId: "2@x", uid: 1, internalDate: day(2), references: []string{"1@x"}}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "Re: Re: X", messageId: "3@x", uid: 2, internalDate: day(3), references: []string{"1@x", "2@x"}}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: sent, subject: "X", messageId: "4@x", uid: 2, internalDate: day(4)}
+
+	expDirItems := map[string][]string{
+		"/threads":       {"X", "X (2)"},
+		"/threads/X":     {"01 X", "02 Re: X", "03 Re: Re: X"},
+		"/threads/X (2)": {"01 X"},
+	}
+	for path, exp := range expDirItems {
+		dirItems = nil
+		fs.Readdir(path, fill, 0, 0)
+		if !checkSubjectsMatch(exp, dirItems) {
+			t.Errorf("Readdir %s exp %s got %s", path, exp, dirItems)
+		}
+	}
+}
+
+func TestUnreadAndFlaggedViews(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	emailNotifier.mailboxes <- []Mailbox{inbox}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "new", uid: 1}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "read", uid: 2, flags: []string{flagSeen}}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "important", uid: 3, flags: []string{"$Important", flagFlagged}}
+
+	expDirItems := map[string][]string{
+		"/unread":  {"new", "important"},
+		"/flagged": {"important"},
+	}
+	for path, exp := range expDirItems {
+		dirItems = nil
+		fs.Readdir(path, fill, 0, 0)
+		if !checkSubjectsMatch(exp, dirItems) {
+			t.Errorf("Readdir %s exp %s got %s", path, exp, dirItems)
+		}
+	}
+
+	// flags changed on the server
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "important", uid: 3, flags: []string{flagSeen}}
+	expDirItems = map[string][]string{
+		"/unread":  {"new"},
+		"/flagged": {},
+	}
+	for path, exp := range expDirItems {
+		dirItems = nil
+		fs.Readdir(path, fill, 0, 0)
+		if !checkSubjectsMatch(exp, dirItems) {
+			t.Errorf("Readdir %s exp %s got %s", path, exp, dirItems)
+		}
+	}
+}
+
+func TestLongDuplicateNamesInViews(t *testing.T) {
+	subject := strings.Repeat("a", 255)
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	mailboxes := []Mailbox{{name: "A", delim: '/'}, {name: "B", delim: '/'}, {name: "C", delim: '/'}}
+	emailNotifier.mailboxes <- mailboxes
+	// the same UID in every mailbox, names are cut to the limit before the suffix
+	for _, mailbox := range mailboxes {
+		emailNotifier.newMessages <- EmailMetadata{mailbox: mailbox, subject: subject, uid: 1}
+	}
+
+	fs.Readdir("/unread", fill, 0, 0)
+	exp := []string{subject, subject[:251] + " (1)", subject[:249] + " (1-2)"}
+	if !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+}
+
+func TestMailboxNamedLikeView(t *testing.T) {
+	unread := Mailbox{name: "unread", delim: '/'}
+	later := Mailbox{name: "unread/later", delim: '/'}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailNotifier: emailNotifier, gmailSearcher: &FakeGmailSearcher{}, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	for _, view := range fs.emailViews() {
+		if !slices.Contains(viewNames, strings.TrimPrefix(view.root, "/")) {
+			t.Errorf("Exp view %s among reserved names %s", view.root, viewNames)
+		}
+	}
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	emailNotifier.mailboxes <- []Mailbox{unread, later}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: unread, subject: "kept", uid: 1, flags: []string{flagSeen}}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: later, subject: "later", uid: 1}
+
+	expDirItems := map[string][]string{
+		"/unread":                 {"later"},
+		"/unread (mailbox)":       {"kept", "later"},
+		"/unread (mailbox)/later": {"later"},
+	}
+	for path, exp := range expDirItems {
+		dirItems = nil
+		fs.Readdir(path, fill, 0, 0)
+		if !checkSubjectsMatch(exp, dirItems) {
+			t.Errorf("Readdir %s exp %s got %s", path, exp, dirItems)
+		}
+	}
+}
+
+func TestSavedSearch(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	archive := Mailbox{name: "Archive", delim: '/'}
+	emailSearcher := &FakeEmailSearcher{results: map[string][]uint64{"INBOX": {1}, "Archive": {1, 5}}}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{emailSearcher: emailSearcher, emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	emailNotifier.mailboxes <- []Mailbox{inbox, archive}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "from alice", uid: 1}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "from bob", uid: 2}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: archive, subject: "archived from alice", uid: 1}
+	fs.Readdir("/", fill, 0, 0)
+
+	query := "from:alice since:2026-01-01 unseen"
+	if errCode := fs.Mkdir("/search/"+query, 0770); errCode != 0 {
+		t.Errorf("Mkdir received %d errc instead of 0", errCode)
+	}
+	if errCode := fs.Mkdir("/search/from:", 0770); errCode != -fuse.EINVAL {
+		t.Errorf("Mkdir received %d errc instead of EINVAL", errCode)
+	}
+
+	// a new search runs in background, matches older than listed messages are fetched
+	if exp, got := []string{"from alice", "archived from alice", "older 5"}, waitForDirItems(&fs, "/search/"+query); !checkSubjectsMatch(exp, got) {
+		t.Errorf("Exp %s got %s", exp, got)
+	}
+	if exp := []uint64{5}; !slices.Equal(emailSearcher.fetched, exp) {
+		t.Errorf("Exp fetched UIDs %v got %v", exp, emailSearcher.fetched)
+	}
+
+	emailSearcher.setResults(map[string][]uint64{"INBOX": {2}})
+	fs.updateSearches()
+	dirItems = nil
+	fs.Readdir("/search/"+query, fill, 0, 0)
+	if exp := []string{"from bob"}; !checkSubjectsMatch(exp, dirItems) {
+		t.Errorf("Exp %s got %s", exp, dirItems)
+	}
+
+	if errCode := fs.Rmdir("/search/" + query); errCode != 0 {
+		t.Errorf("Rmdir received %d errc instead of 0", errCode)
+	}
+	dirItems = nil
+	fs.Readdir("/search", fill, 0, 0)
+	if len(dirItems) != 0 {
+		t.Errorf("Exp no saved searches, got %s", dirItems)
+	}
+}
+
+func TestGmailSearch(t *testing.T) {
+	inbox := Mailbox{name: "INBOX", delim: '/'}
+	allMail := Mailbox{name: "[Gmail]/All Mail", delim: '/', all: true}
+	gmailSearcher := &FakeGmailSearcher{results: map[string][]uint64{"INBOX": {1}, "[Gmail]/All Mail": {7, 9}}}
+	emailSearcher := &FakeEmailSearcher{}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{gmailSearcher: gmailSearcher, emailSearcher: emailSearcher, emailNotifier: emailNotifier, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	emailNotifier.mailboxes <- []Mailbox{inbox, allMail}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: inbox, subject: "report", uid: 1}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: allMail, subject: "report", uid: 7}
+	emailNotifier.newMessages <- EmailMetadata{mailbox: allMail, subject: "promo", uid: 8}
+	fs.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool { return true }, 0, 0)
+
+	// the search runs in All Mail only, so a message with several labels matches once
+	query := "has:attachment older_than:1y"
+	if errCode := fs.Mkdir("/gmail-search/"+query, 0770); errCode != 0 {
+		t.Errorf("Mkdir received %d errc instead of 0", errCode)
+	}
+	if exp, got := []string{"report", "older 9"}, waitForDirItems(&fs, "/gmail-search/"+query); !checkSubjectsMatch(exp, got) {
+		t.Errorf("Exp %s got %s", exp, got)
+	}
+	if errCode := fs.Rmdir("/gmail-search/" + query); errCode != 0 {
+		t.Errorf("Rmdir received %d errc instead of 0", errCode)
+	}
+}
+
+// Lists the directory until it is not empty, as searches run in background
+func waitForDirItems(fs *EmailFs, path string) []string {
+	var dirItems []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		dirItems = append(dirItems, name)
+		return true
+	}
+	for deadline := time.Now().Add(time.Second); len(dirItems) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		fs.Readdir(path, fill, 0, 0)
+	}
+	return dirItems
+}
+
+func checkSubjectsMatch(submittedSubjects []string, listedSubjects []string) bool {
+	slices.Sort(submittedSubjects)
+	slices.Sort(listedSubjects)
+	return slices.Compare(submittedSubjects, listedSubjects) == 0
+}
+
+func virtualRootNames() []string {
+	var names []string
+	for _, view := range (&EmailFs{}).emailViews() {
+		names = append(names, view.root[1:])
+	}
+	return names
 }
 
 func createNeverTickUpdateIntervalTimer() <-chan time.Time {
@@ -5,18 +5,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
 	"os"
 
 	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-message"
 	"github.com/emersion/go-sasl"
 	"golang.org/x/oauth2"
 )
 
 type GmailAuthorizer struct {
 	c             *imapclient.Client
+	gmail         *GmailImap
 	tokenFilepath string
+	tokenSrc      oauth2.TokenSource
 }
 
 func (self *GmailAuthorizer) Login() (EmailInterface, error) {
@@ -45,8 +49,8 @@ func (self *GmailAuthorizer) Login() (EmailInterface, error) {
 	}
 
 	// Get fresh token (handles refresh automatically)
-	tokenSrc := conf.TokenSource(context.Background(), token)
-	freshToken, err := tokenSrc.Token()
+	self.tokenSrc = conf.TokenSource(context.Background(), token)
+	freshToken, err := self.tokenSrc.Token()
 	if err != nil {
 		return nil, fmt.Errorf("token refresh failed: %w", err)
 	}
@@ -58,7 +62,13 @@ func (self *GmailAuthorizer) Login() (EmailInterface, error) {
 		return nil, fmt.Errorf("IMAP authentication failed: %w", err)
 	}
 
-	return &GoImapEmailInterface{c: self.c}, nil
+	self.gmail = NewGmailImap(email, self.tokenSrc)
+	return &GoImapEmailInterface{c: self.c, gmail: self.gmail}, nil
+}
+
+// Searcher of Gmail's query syntax, available after Login
+func (self *GmailAuthorizer) Searcher() *GmailImap {
+	return self.gmail
 }
 
 func (s *GmailAuthorizer) Logout() error {
@@ -66,7 +76,9 @@ func (s *GmailAuthorizer) Logout() error {
 }
 
 func NewGAuth(tokenFilepath string) (*GmailAuthorizer, error) {
-	c, err := imapclient.DialTLS("imap.gmail.com:993", nil)
+	// envelope subjects and names are decoded with the charsets of message bodies
+	options := &imapclient.Options{WordDecoder: &mime.WordDecoder{CharsetReader: message.CharsetReader}}
+	c, err := imapclient.DialTLS(gmailImapAddr, options)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+const gmailImapAddr = "imap.gmail.com:993"
+
+var (
+	gmailMsgIdPattern = regexp.MustCompile(`X-GM-MSGID (\d+)`)
+	uidPattern        = regexp.MustCompile(`UID (\d+)`)
+	literalPattern    = regexp.MustCompile(`\{(\d+)\+?\}$`)
+)
+
+// Sends Gmail's IMAP extension commands, which go-imap can't send, over a connection of its own.
+// The connection is made on first use and made again after an error
+type GmailImap struct {
+	username string
+	tokenSrc oauth2.TokenSource
+	dial     func() (net.Conn, error)
+	lock     sync.Mutex
+	conn     net.Conn
+	r        *bufio.Reader
+	tag      int
+	selected string
+}
+
+func NewGmailImap(username string, tokenSrc oauth2.TokenSource) *GmailImap {
+	dial := func() (net.Conn, error) {
+		return tls.Dial("tcp", gmailImapAddr, nil)
+	}
+	return &GmailImap{username: username, tokenSrc: tokenSrc, dial: dial}
+}
+
+// X-GM-MSGIDs of the messages by their UIDs in the mailbox, the ID is the same in every label of a message
+func (self *GmailImap) messageIds(mailbox string, uids []uint64) (map[uint64]uint64, error) {
+	ids := make(map[uint64]uint64)
+	if len(uids) == 0 {
+		return ids, nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.examine(mailbox); err != nil {
+		return nil, err
+	}
+	uidSet := make([]string, len(uids))
+	for i, uid := range uids {
+		uidSet[i] = strconv.FormatUint(uid, 10)
+	}
+	lines, err := self.command("UID FETCH " + strings.Join(uidSet, ",") + " (UID X-GM-MSGID)")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		msgId := gmailMsgIdPattern.FindStringSubmatch(line)
+		uid := uidPattern.FindStringSubmatch(line)
+		if !strings.Contains(line, " FETCH ") || msgId == nil || uid == nil {
+			continue
+		}
+		id, _ := strconv.ParseUint(msgId[1], 10, 64)
+		uidNum, _ := strconv.ParseUint(uid[1], 10, 64)
+		ids[uidNum] = id
+	}
+	return ids, nil
+}
+
+// UIDs of messages in the mailbox matching a query in Gmail's search syntax
+func (self *GmailImap) gmailSearch(mailbox string, query string) ([]uint64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.examine(mailbox); err != nil {
+		return nil, err
+	}
+	lines, err := self.command("UID SEARCH X-GM-RAW " + quoteImap(query))
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint64
+	for _, line := range lines {
+		results, found := strings.CutPrefix(line, "* SEARCH")
+		if !found {
+			continue
+		}
+		for _, field := range strings.Fields(results) {
+			if uid, err := strconv.ParseUint(field, 10, 64); err == nil {
+				uids = append(uids, uid)
+			}
+		}
+	}
+	return uids, nil
+}
+
+// Selects the mailbox read-only unless it is selected already, the caller must hold the lock
+func (self *GmailImap) examine(mailbox string) error {
+	if self.conn != nil && self.selected == mailbox {
+		return nil
+	}
+	if _, err := self.command("EXAMINE " + quoteImap(mailbox)); err != nil {
+		self.selected = ""
+		return err
+	}
+	self.selected = mailbox
+	return nil
+}
+
+// Connects and authenticates, mailbox names and queries are sent as UTF-8. The caller must hold the lock
+func (self *GmailImap) connect() error {
+	conn, err := self.dial()
+	if err != nil {
+		return err
+	}
+	self.conn, self.r, self.selected = conn, bufio.NewReader(conn), ""
+	if _, err := self.readLine(); err != nil {
+		return self.fail(err)
+	}
+	token, err := self.tokenSrc.Token()
+	if err != nil {
+		return self.fail(err)
+	}
+	xoauth2 := fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", self.username, token.AccessToken)
+	if _, err := self.send("AUTHENTICATE XOAUTH2 " + base64.StdEncoding.EncodeToString([]byte(xoauth2))); err != nil {
+		return self.fail(err)
+	}
+	if _, err := self.send("ENABLE UTF8=ACCEPT"); err != nil {
+		return self.fail(err)
+	}
+	return nil
+}
+
+// Runs the command, connecting first if needed, and returns its untagged responses
+func (self *GmailImap) command(command string) ([]string, error) {
+	if self.conn == nil {
+		if err := self.connect(); err != nil {
+			return nil, err
+		}
+	}
+	return self.send(command)
+}
+
+// Sends the command over the connection, which is dropped on I/O errors. The caller must hold the lock
+func (self *GmailImap) send(command string) ([]string, error) {
+	self.tag++
+	tag := fmt.Sprintf("g%d", self.tag)
+	if _, err := io.WriteString(self.conn, tag+" "+command+"\r\n"); err != nil {
+		return nil, self.fail(err)
+	}
+	var untagged []string
+	for {
+		line, err := self.readLine()
+		if err != nil {
+			return nil, self.fail(err)
+		}
+		switch {
+		case strings.HasPrefix(line, "+"):
+			// the server explains a failed authentication and waits for an empty response
+			if _, err := io.WriteString(self.conn, "\r\n"); err != nil {
+				return nil, self.fail(err)
+			}
+		case strings.HasPrefix(line, tag+" "):
+			status := strings.TrimPrefix(line, tag+" ")
+			if !strings.HasPrefix(status, "OK") {
+				return nil, fmt.Errorf("gmail imap: %s", status)
+			}
+			return untagged, nil
+		default:
+			untagged = append(untagged, line)
+		}
+	}
+}
+
+// Reads a response line, with the literals it holds inlined
+func (self *GmailImap) readLine() (string, error) {
+	var line strings.Builder
+	for {
+		part, err := self.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		part = strings.TrimRight(part, "\r\n")
+		line.WriteString(part)
+		match := literalPattern.FindStringSubmatch(part)
+		if match == nil {
+			return line.String(), nil
+		}
+		size, _ := strconv.Atoi(match[1])
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(self.r, literal); err != nil {
+			return "", err
+		}
+		line.Write(literal)
+	}
+}
+
+func (self *GmailImap) fail(err error) error {
+	if self.conn != nil {
+		self.conn.Close()
+	}
+	self.conn, self.r, self.selected = nil, nil, ""
+	return err
+}
+
+func quoteImap(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
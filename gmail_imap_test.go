@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// Answers commands of a GmailImap with the responses, in the order the commands are expected
+func fakeGmailServer(conn net.Conn, responses map[string][]string) {
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("* OK Gimap ready\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		name, _, _ := strings.Cut(command, " ")
+		if strings.HasPrefix(command, "UID ") {
+			name = "UID " + strings.Fields(command)[1]
+		}
+		for _, response := range responses[name] {
+			conn.Write([]byte(response + "\r\n"))
+		}
+		conn.Write([]byte(tag + " OK done\r\n"))
+	}
+}
+
+func TestGmailMessageIds(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeGmailServer(server, map[string][]string{
+		"EXAMINE": {"* 3 EXISTS"},
+		"UID FETCH": {
+			"* 1 FETCH (X-GM-MSGID 1278455344230334865 UID 4)",
+			"* 2 FETCH (UID 7 X-GM-MSGID 1278455344230334866)",
+		},
+	})
+	gmail := &GmailImap{
+		username: "me@gmail.com",
+		tokenSrc: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}),
+		dial:     func() (net.Conn, error) { return client, nil },
+	}
+
+	ids, err := gmail.messageIds("[Gmail]/All Mail", []uint64{4, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids[4] != 1278455344230334865 || ids[7] != 1278455344230334866 {
+		t.Errorf("Exp X-GM-MSGIDs of UIDs 4 and 7, got %v", ids)
+	}
+}
+
+func TestGmailImapSearch(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeGmailServer(server, map[string][]string{
+		"UID SEARCH": {"* SEARCH 3 12"},
+	})
+	gmail := &GmailImap{
+		username: "me@gmail.com",
+		tokenSrc: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}),
+		dial:     func() (net.Conn, error) { return client, nil },
+	}
+
+	uids, err := gmail.gmailSearch("[Gmail]/All Mail", `has:attachment subject:"weekly report"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []uint64{3, 12}; !slices.Equal(uids, exp) {
+		t.Errorf("Exp UIDs %v got %v", exp, uids)
+	}
+}
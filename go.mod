@@ -3,10 +3,20 @@ module github.com/anton-ptashnik/emailfs
 go 1.24.2
 
 require (
+	github.com/ProtonMail/go-crypto v1.4.1
 	github.com/emersion/go-imap/v2 v2.0.0-beta.5
 	github.com/emersion/go-message v0.18.1
 	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6
 	github.com/joho/godotenv v1.5.1
+	github.com/smallstep/pkcs7 v0.2.1
 	github.com/winfsp/cgofuse v1.6.0
+	golang.org/x/net v0.42.0
 	golang.org/x/oauth2 v0.30.0
 )
+
+require (
+	github.com/cloudflare/circl v1.6.2 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+)
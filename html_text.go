@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Renders an HTML body as plain text. Links are numbered and listed as footnotes at the end,
+// lists get bullets or numbers and table columns are aligned
+func renderHtml(data []byte) []byte {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		// the parser recovers from malformed markup, only reading can fail
+		return data
+	}
+	r := &textRenderer{links: new([]string), lineStart: true}
+	r.render(doc)
+
+	text := strings.TrimSpace(r.out.String())
+	if len(*r.links) > 0 {
+		text += "\n"
+		for i, link := range *r.links {
+			text += fmt.Sprintf("\n[%d] %s", i+1, link)
+		}
+	}
+	return []byte(text + "\n")
+}
+
+type textRenderer struct {
+	out strings.Builder
+	// link targets in order of appearance, shared with renderers of table cells
+	links *[]string
+	// written at the start of every line, e.g. list indents and quote marks
+	prefixes []string
+	// list item marker replacing the last prefix on the next line
+	marker string
+	pre    int
+	// a line was started and nothing is written on it yet
+	lineStart bool
+	// whitespace is due before the next word
+	space bool
+	// number of line breaks the output ends with
+	newlines int
+}
+
+func (r *textRenderer) render(n *html.Node) {
+	if n.Type == html.TextNode {
+		r.text(n.Data)
+		return
+	}
+	if n.Type != html.ElementNode {
+		r.renderChildren(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title, atom.Noscript, atom.Template:
+	case atom.Br:
+		r.newline()
+	case atom.Hr:
+		r.ensureNewlines(1)
+		r.startLine()
+		r.out.WriteString("----")
+		r.ensureNewlines(1)
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			r.text("[" + alt + "]")
+		}
+	case atom.A:
+		r.renderChildren(n)
+		r.link(n)
+	case atom.Ul, atom.Ol:
+		r.list(n)
+	case atom.Table:
+		r.table(n)
+	case atom.Blockquote:
+		r.ensureNewlines(2)
+		r.prefixes = append(r.prefixes, "> ")
+		r.renderChildren(n)
+		r.prefixes = r.prefixes[:len(r.prefixes)-1]
+		r.ensureNewlines(2)
+	case atom.Pre:
+		r.ensureNewlines(2)
+		r.pre++
+		r.renderChildren(n)
+		r.pre--
+		r.ensureNewlines(2)
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Dl, atom.Figure:
+		r.ensureNewlines(2)
+		r.renderChildren(n)
+		r.ensureNewlines(2)
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Nav, atom.Main, atom.Aside,
+		atom.Address, atom.Center, atom.Form, atom.Tr, atom.Li, atom.Dt, atom.Dd, atom.Caption:
+		r.ensureNewlines(1)
+		r.renderChildren(n)
+		r.ensureNewlines(1)
+	default:
+		r.renderChildren(n)
+	}
+}
+
+func (r *textRenderer) renderChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+// Writes text collapsing whitespace, unless inside pre
+func (r *textRenderer) text(s string) {
+	if r.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				r.newline()
+			}
+			if line != "" {
+				r.startLine()
+				r.out.WriteString(line)
+			}
+		}
+		return
+	}
+
+	first, _ := utf8.DecodeRuneInString(s)
+	last, _ := utf8.DecodeLastRuneInString(s)
+	for i, word := range strings.Fields(s) {
+		if (i > 0 || r.space || unicode.IsSpace(first)) && !r.lineStart {
+			r.out.WriteByte(' ')
+		}
+		r.space = false
+		r.startLine()
+		r.out.WriteString(word)
+	}
+	if s != "" && unicode.IsSpace(last) {
+		r.space = true
+	}
+}
+
+// Writes prefixes if nothing is written on the current line yet
+func (r *textRenderer) startLine() {
+	if !r.lineStart {
+		return
+	}
+	if r.marker != "" {
+		r.out.WriteString(strings.Join(r.prefixes[:len(r.prefixes)-1], "") + r.marker)
+		r.marker = ""
+	} else {
+		r.out.WriteString(strings.Join(r.prefixes, ""))
+	}
+	r.lineStart = false
+	r.newlines = 0
+}
+
+func (r *textRenderer) newline() {
+	r.out.WriteByte('\n')
+	r.newlines++
+	r.lineStart = true
+	r.space = false
+}
+
+// Ends the current line and adds empty lines so blocks are separated by n-1 of them
+func (r *textRenderer) ensureNewlines(n int) {
+	if r.out.Len() == 0 {
+		return
+	}
+	for r.newlines < n {
+		r.newline()
+	}
+}
+
+// Adds a footnote reference after the link text, unless the text is the link itself
+func (r *textRenderer) link(n *html.Node) {
+	href := strings.TrimSpace(attr(n, "href"))
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		return
+	}
+	text := strings.TrimSpace(nodeText(n))
+	if text == href || "mailto:"+text == href {
+		return
+	}
+	index := slices.Index(*r.links, href)
+	if index == -1 {
+		*r.links = append(*r.links, href)
+		index = len(*r.links) - 1
+	}
+	r.startLine()
+	r.out.WriteString(fmt.Sprintf("[%d]", index+1))
+}
+
+func (r *textRenderer) list(n *html.Node) {
+	r.ensureNewlines(1)
+	number := 1
+	if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+		number = start
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			r.render(c)
+			continue
+		}
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+		r.ensureNewlines(1)
+		r.prefixes = append(r.prefixes, strings.Repeat(" ", len(marker)))
+		r.marker = marker
+		r.renderChildren(c)
+		r.marker = ""
+		r.prefixes = r.prefixes[:len(r.prefixes)-1]
+		r.ensureNewlines(1)
+	}
+}
+
+// Renders a data table with aligned columns, tables used for page layout have their cells rendered as blocks
+func (r *textRenderer) table(n *html.Node) {
+	rows := tableRows(n)
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+	if columns < 2 || slices.ContainsFunc(rows, func(row []*html.Node) bool { return slices.ContainsFunc(row, hasBlocks) }) {
+		r.ensureNewlines(1)
+		for _, row := range rows {
+			for _, cell := range row {
+				r.ensureNewlines(1)
+				r.renderChildren(cell)
+				r.ensureNewlines(1)
+			}
+		}
+		return
+	}
+
+	var cells [][]string
+	widths := make([]int, columns)
+	for _, row := range rows {
+		var texts []string
+		for i, cell := range row {
+			cellRenderer := &textRenderer{links: r.links, lineStart: true}
+			cellRenderer.renderChildren(cell)
+			text := strings.Join(strings.Fields(cellRenderer.out.String()), " ")
+			texts = append(texts, text)
+			widths[i] = max(widths[i], utf8.RuneCountInString(text))
+		}
+		cells = append(cells, texts)
+	}
+	r.ensureNewlines(2)
+	for _, texts := range cells {
+		var line strings.Builder
+		for i, text := range texts {
+			if i > 0 {
+				line.WriteString("  ")
+			}
+			line.WriteString(text)
+			line.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(text)))
+		}
+		if text := strings.TrimRight(line.String(), " "); text != "" {
+			r.startLine()
+			r.out.WriteString(text)
+			r.newline()
+		}
+	}
+	r.ensureNewlines(2)
+}
+
+// Cells by rows of the table, not including nested tables
+func tableRows(table *html.Node) [][]*html.Node {
+	var rows [][]*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || c.DataAtom == atom.Table {
+				continue
+			}
+			if c.DataAtom != atom.Tr {
+				walk(c)
+				continue
+			}
+			var row []*html.Node
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+					row = append(row, cell)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	walk(table)
+	return rows
+}
+
+// Reports whether the node holds elements which can't be rendered on a single line
+func hasBlocks(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		switch c.DataAtom {
+		case atom.Table, atom.P, atom.Div, atom.Br, atom.Ul, atom.Ol, atom.Blockquote, atom.Pre,
+			atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+			return true
+		}
+		if hasBlocks(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var text strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		text.WriteString(nodeText(c))
+	}
+	return text.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestRenderHtml(t *testing.T) {
+	tests := map[string]string{
+		`<html><head><title>t</title><style>p {}</style></head><body><p>Hello   <b>world</b></p><p>Second<br>line</p></body></html>`: "Hello world\n\nSecond\nline\n",
+		`<p>See <a href="https://example.com/a">the docs</a> and <a href="https://example.com/a">again</a>, or <a href="https://example.com">https://example.com</a></p>`: "See the docs[1] and again[1], or https://example.com\n\n[1] https://example.com/a\n",
+		`<ul><li>one</li><li>two<ol><li>nested</li></ol></li></ul>`: "- one\n- two\n  1. nested\n",
+		`<table><tr><th>Item</th><th>Qty</th></tr><tr><td>Apple</td><td>10</td></tr></table>`: "Item   Qty\nApple  10\n",
+		`<table><tr><td><p>layout</p><p>table</p></td></tr></table>`: "layout\n\ntable\n",
+		`<blockquote>quoted<br>text</blockquote><pre>a  b
+c</pre>`: "> quoted\n> text\n\na  b\nc\n",
+	}
+	for input, exp := range tests {
+		if got := string(renderHtml([]byte(input))); got != exp {
+			t.Errorf("Rendering %s exp %q got %q", input, exp, got)
+		}
+	}
+}
+
+func TestRenderMode(t *testing.T) {
+	htmlOnly := &emailParts{html: []byte("<p>html</p>")}
+	both := &emailParts{text: []byte("plain"), html: []byte("<p>html</p>")}
+	tests := []struct {
+		parts *emailParts
+		mode  renderMode
+		exp   string
+	}{
+		{htmlOnly, renderPlain, ""},
+		{htmlOnly, renderPreferPlain, "html\n"},
+		{both, renderPreferPlain, "plain"},
+		{both, renderHtmlMode, "html\n"},
+	}
+	for _, test := range tests {
+		if got := string(test.parts.body(test.mode)); got != test.exp {
+			t.Errorf("Mode %s exp %q got %q", test.mode, test.exp, got)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/user"
@@ -10,15 +12,23 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/emersion/go-message"
 	"github.com/joho/godotenv"
 	"github.com/winfsp/cgofuse/fuse"
 )
 
 func main() {
+	args, err := parseArgs()
+	if err != nil {
+		printUsage()
+		os.Exit(1)
+	}
+
 	user, _ := user.Current()
 	userId64, _ := strconv.ParseUint(user.Uid, 10, 16)
 	userId := uint(userId64)
 	godotenv.Load()
+	message.CharsetReader = args.charsetMode.reader
 
 	exePath, _ := os.Executable()
 	exeDir := filepath.Dir(exePath)
@@ -30,38 +40,104 @@ func main() {
 	}
 	defer emailAuth.Logout()
 
+	messageKeys, err := loadMessageKeys()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	emailNotifier := NewGoImapUpdatesNotifier(emailInterface)
-	emailReader := NewGoImapEmailReader(emailInterface)
+	emailReader := NewGoImapEmailReader(emailInterface, args.renderMode, messageKeys)
 	hellofs := &EmailFs{
-		emailNotifier: emailNotifier,
-		emailReader:   emailReader,
-		emailRemover:  emailInterface,
-		userId:        userId,
+		emailNotifier:         emailNotifier,
+		emailReader:           emailReader,
+		rawEmailReader:        emailReader,
+		attachmentReader:      emailInterface,
+		emailRemover:          emailInterface,
+		emailMover:            emailInterface,
+		emailLabeler:          emailInterface,
+		emailFlagger:          emailInterface,
+		mailboxManager:        emailInterface,
+		emailSearcher:         emailInterface,
+		gmailSearcher:         emailAuth.Searcher(),
+		userId:                userId,
+		gmailLabels:           args.gmailLabels,
+		messageDirs:           args.messageDirs,
+		emlFiles:              args.emlFiles,
+		renderMode:            args.renderMode,
+		messageKeys:           messageKeys,
+		nameTemplate:          args.nameTemplate,
+		extensions:            args.extensions,
+		searchesFilepath:      filepath.Join(exeDir, "searches.txt"),
+		gmailSearchesFilepath: filepath.Join(exeDir, "gmail-searches.txt"),
 		//todo increase delay after testing
 		updateIntervalTimer: func() <-chan time.Time {
 			return time.After(time.Minute * 1)
 		},
 	}
 	host := fuse.NewFileSystemHost(hellofs)
-	args, err := parseArgs()
-	if err != nil {
-		printUsage()
-		os.Exit(1)
+	var mountOpts []string
+	if args.gmailLabels {
+		// inode numbers tie a message to all its label directories
+		mountOpts = append(mountOpts, "-o", "use_ino")
 	}
-	host.Mount(args.mountpoint, nil)
+	host.Mount(args.mountpoint, mountOpts)
 }
 
 type argsStruct struct {
-	mountpoint string
+	mountpoint   string
+	gmailLabels  bool
+	messageDirs  bool
+	emlFiles     bool
+	renderMode   renderMode
+	charsetMode  charsetMode
+	nameTemplate nameTemplate
+	extensions   bool
+}
+
+func newFlagSet(args *argsStruct) *flag.FlagSet {
+	flags := flag.NewFlagSet("emailfs", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.BoolVar(&args.gmailLabels, "gmail-labels", false, "treat mailboxes as Gmail labels: a message with several labels is hard-linked into each label directory")
+	flags.BoolVar(&args.messageDirs, "message-dirs", false, "expose messages as directories holding body.txt, body.html, headers, raw.eml and attachments")
+	args.renderMode = renderPreferPlain
+	flags.Func("render", "message text: plain for text/plain parts only, prefer-plain to render HTML when there is no text/plain part, html to prefer rendered HTML (default prefer-plain)", func(value string) error {
+		mode, err := parseRenderMode(value)
+		args.renderMode = mode
+		return err
+	})
+	args.charsetMode = charsetReplace
+	flags.Func("charset", "text with bytes invalid in its charset: replace to substitute U+FFFD for them, raw to keep the text undecoded (default replace)", func(value string) error {
+		mode, err := parseCharsetMode(value)
+		args.charsetMode = mode
+		return err
+	})
+	flags.Func("name-template", "message filenames, with fields {subject}, {date}, {received}, {from}, {from.name}, {from.address}, {uid}, {size} and {flags}. Dates take a Go time layout, e.g. {date:2006-01-02} (default {subject})", func(value string) error {
+		template, err := parseNameTemplate(value)
+		args.nameTemplate = template
+		return err
+	})
+	flags.BoolVar(&args.emlFiles, "eml", false, "list the raw message as <name>.eml next to every message file")
+	flags.BoolVar(&args.extensions, "extensions", true, "end message filenames with .txt, or .ics for invitations without text; -extensions=false leaves them bare")
+	return flags
 }
 
 func parseArgs() (argsStruct, error) {
-	if len(os.Args) != 2 {
+	var args argsStruct
+	flags := newFlagSet(&args)
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return argsStruct{}, err
+	}
+	if flags.NArg() != 1 {
 		return argsStruct{}, errors.New("wrong usage")
 	}
-	return argsStruct{mountpoint: os.Args[1]}, nil
+	args.mountpoint = flags.Arg(0)
+	return args, nil
 }
 
 func printUsage() {
-	fmt.Println("Usage: emailfs <mountpoint>")
+	fmt.Println("Usage: emailfs [options] <mountpoint>")
+	fmt.Println("Options:")
+	flags := newFlagSet(&argsStruct{})
+	flags.SetOutput(os.Stdout)
+	flags.PrintDefaults()
 }
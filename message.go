@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// Contents of a message split into the files it is exposed as
+type emailParts struct {
+	header []byte
+	text   []byte
+	html   []byte
+	// iCalendar of an invitation
+	calendar []byte
+	raw      []byte
+	// of signed and encrypted messages, empty for others
+	signature signatureStatus
+}
+
+// Chooses what a message's text is made of
+type renderMode string
+
+const (
+	// text/plain parts only
+	renderPlain renderMode = "plain"
+	// text/plain parts, or HTML rendered as text when there are none
+	renderPreferPlain renderMode = "prefer-plain"
+	// HTML rendered as text, or text/plain parts when there is no HTML
+	renderHtmlMode renderMode = "html"
+)
+
+func parseRenderMode(value string) (renderMode, error) {
+	switch mode := renderMode(value); mode {
+	case renderPlain, renderPreferPlain, renderHtmlMode:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown render mode %s", value)
+}
+
+// Text of the message in the given mode, the empty mode stands for prefer-plain.
+// Invitations without text are read as their calendar
+func (self *emailParts) body(mode renderMode) []byte {
+	switch {
+	case self.text == nil && self.html == nil:
+		return self.calendar
+	case mode == renderPlain || self.html == nil:
+		return self.text
+	case mode == renderHtmlMode || self.text == nil:
+		return renderHtml(self.html)
+	}
+	return self.text
+}
+
+// Header fields with encoded words decoded to UTF-8, one per line
+func decodeHeader(h message.Header) []byte {
+	var header bytes.Buffer
+	fields := h.Fields()
+	for fields.Next() {
+		// undecodable fields are kept as they are
+		value, _ := fields.Text()
+		fmt.Fprintf(&header, "%s: %s\r\n", fields.Key(), value)
+	}
+	return header.Bytes()
+}
+
+// Splits a raw RFC 822 message into its header, text and HTML bodies and calendar, attachments are read separately.
+// Encrypted messages are split after they are decrypted
+func parseEmail(raw []byte, keys messageKeys) (*emailParts, error) {
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, err
+	}
+	parts := &emailParts{header: decodeHeader(mr.Header.Header), raw: raw}
+	var sender string
+	if from, err := mr.Header.AddressList("From"); err == nil && len(from) > 0 {
+		sender = from[0].Address
+	}
+	if content, signature := keys.unwrap(raw, sender); signature != "" {
+		parts.signature = signature
+		mr, err = mail.CreateReader(bytes.NewReader(content))
+		if err != nil && !message.IsUnknownCharset(err) {
+			return nil, err
+		}
+	}
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil && !message.IsUnknownCharset(err) {
+			return nil, err
+		}
+		h, inline := p.Header.(*mail.InlineHeader)
+		if !inline {
+			continue
+		}
+		switch mediaType, _, _ := h.ContentType(); mediaType {
+		case "text/plain":
+			body, err := io.ReadAll(p.Body)
+			if err != nil {
+				return nil, err
+			}
+			parts.text = append(parts.text, body...)
+		case "text/html":
+			body, err := io.ReadAll(p.Body)
+			if err != nil {
+				return nil, err
+			}
+			parts.html = append(parts.html, body...)
+		case "text/calendar":
+			body, err := io.ReadAll(p.Body)
+			if err != nil {
+				return nil, err
+			}
+			parts.calendar = append(parts.calendar, body...)
+		}
+	}
+	return parts, nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	pathpkg "path"
+	"strings"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const (
+	attachmentsDir = "attachments"
+	// signature status of signed and encrypted messages, also the extension of status files next to message files
+	sigStatusFile = ".sig-status"
+	// parsed messages and attachment lists kept in memory, opening a file of a message usually follows listing it
+	parsedEmailsLimit = 16
+)
+
+// Identifies a message, or a message attached to it by the section of its part
+type partId struct {
+	emailId
+	section string
+}
+
+// Finds the message directory the path is in, returning the message and the path relative to its directory.
+// The caller must hold the lock
+func (self *EmailFs) lookupMessagePath(path string) (EmailMetadata, string, bool) {
+	if !self.messageDirs {
+		return EmailMetadata{}, "", false
+	}
+	for dir := path; dir != "/"; dir, _ = splitPath(dir) {
+		if email, found := self.lookupFile(dir); found {
+			return email, strings.TrimPrefix(strings.TrimPrefix(path, dir), "/"), true
+		}
+	}
+	return EmailMetadata{}, "", false
+}
+
+// Signed and encrypted messages have their signature status listed as <name>.sig-status next to message files,
+// message directories hold it inside
+func (self *EmailFs) hasSigStatusFile(email EmailMetadata) bool {
+	return email.secured && !self.messageDirs
+}
+
+// The caller must hold the lock
+func (self *EmailFs) lookupSigStatusFile(path string) (EmailMetadata, bool) {
+	email, found := self.lookupCompanionFile(path, sigStatusFile)
+	return email, found && self.hasSigStatusFile(email)
+}
+
+// The status is known once the message is parsed, until then the size of the longest one is reported.
+// The caller must hold the lock
+func (self *EmailFs) fillSigStatusStat(email EmailMetadata, stat *fuse.Stat_t) {
+	self.fillEmailStat(email, stat)
+	stat.Mode = fuse.S_IFREG | 0440
+	stat.Size = int64(len(signatureUnknownKey) + 1)
+	if parts, found := self.parsedEmails.get(partId{emailId: email.id()}); found {
+		stat.Size = int64(len(parts.signature) + 1)
+	}
+	stat.Blocks = 1
+	stat.Ino = emailInode(fmt.Sprintf("%d%s", stat.Ino, sigStatusFile))
+}
+
+// Opens the signature status file with direct I/O as its size may have been an estimate,
+// must be called without the lock held
+func (self *EmailFs) openSigStatus(email EmailMetadata) (int, uint64, bool) {
+	parts, err := self.emailParts(email, nil)
+	if err != nil {
+		log.Printf("Error reading message %d in %s: %v\n", email.uid, email.mailbox.name, err)
+		return -fuse.EIO, ^uint64(0), false
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.nextFh++
+	self.openFiles[self.nextFh] = string(parts.signature) + "\n"
+	return 0, self.nextFh, true
+}
+
+// Files of a message directory by name, attachments are listed in their own directory
+func (self *emailParts) files(mode renderMode) map[string][]byte {
+	files := map[string][]byte{
+		"body.txt": self.body(mode),
+		"headers":  self.header,
+		"raw.eml":  self.raw,
+	}
+	if self.html != nil {
+		files["body.html"] = self.html
+	}
+	if self.calendar != nil {
+		files["invite.ics"] = self.calendar
+	}
+	if self.signature != "" {
+		files[sigStatusFile] = []byte(self.signature + "\n")
+	}
+	return files
+}
+
+// Fetches and parses the message, or the attached message, unless it was parsed recently.
+// Must be called without the lock held
+func (self *EmailFs) emailParts(email EmailMetadata, attached *Attachment) (*emailParts, error) {
+	id := partId{emailId: email.id()}
+	if attached != nil {
+		id.section = attached.section()
+	}
+	self.lock.Lock()
+	parts, found := self.parsedEmails.get(id)
+	self.lock.Unlock()
+	if found {
+		return parts, nil
+	}
+
+	var raw []byte
+	var err error
+	if attached == nil {
+		raw, err = self.rawEmailReader.readRaw(email.mailbox.name, email.uid)
+	} else {
+		raw, err = self.attachmentReader.readAttachment(email.mailbox.name, email.uid, *attached)
+	}
+	if err != nil {
+		return nil, err
+	}
+	parts, err = parseEmail(raw, self.messageKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.parsedEmails.put(id, parts)
+	return parts, nil
+}
+
+// Lists attachments by their path in the message directory unless they were listed recently,
+// must be called without the lock held
+func (self *EmailFs) emailAttachments(email EmailMetadata) (map[string]Attachment, error) {
+	self.lock.Lock()
+	attachments, found := self.attachments.get(email.id())
+	self.lock.Unlock()
+	if found {
+		return attachments, nil
+	}
+
+	list, err := self.attachmentReader.attachments(email.mailbox.name, email.uid)
+	if err != nil {
+		return nil, err
+	}
+	attachments = make(map[string]Attachment)
+	attachmentPaths("", list, attachments)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.attachments.put(email.id(), attachments)
+	return attachments, nil
+}
+
+// Records the size of an attachment known once it is read
+func (self *EmailFs) setAttachmentSize(email EmailMetadata, path string, size int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if attachments, found := self.attachments.get(email.id()); found {
+		if attachment, found := attachments[path]; found {
+			attachment.size = size
+			attachment.exact = true
+			attachments[path] = attachment
+		}
+	}
+}
+
+// A path inside a message directory resolved to the message or attached message it belongs to
+type messageNode struct {
+	// path of the attached message directory, empty for the message itself
+	dir      string
+	attached *Attachment
+	// path relative to the directory of the message
+	path string
+	// attachments by their path in the message directory, listed only for paths among attachments
+	attachments map[string]Attachment
+}
+
+// Resolves a path inside the message directory, must be called without the lock held
+func (self *EmailFs) messageNode(email EmailMetadata, path string) (messageNode, error) {
+	if path != attachmentsDir && !strings.HasPrefix(path, attachmentsDir+"/") {
+		return messageNode{path: path}, nil
+	}
+	attachments, err := self.emailAttachments(email)
+	if err != nil {
+		return messageNode{}, err
+	}
+	for dir := path; dir != "."; dir = pathpkg.Dir(dir) {
+		if attachment, found := attachments[dir]; found && attachment.message {
+			path := strings.TrimPrefix(strings.TrimPrefix(path, dir), "/")
+			return messageNode{dir: dir, attached: &attachment, path: path, attachments: attachments}, nil
+		}
+	}
+	return messageNode{path: path, attachments: attachments}, nil
+}
+
+// Path of a file of the node in the message directory
+func (self messageNode) fullPath(path string) string {
+	return pathpkg.Join(self.dir, path)
+}
+
+func (self *EmailFs) messageDirStat(email EmailMetadata, path string, stat *fuse.Stat_t) {
+	stat.Uid = uint32(self.userId)
+	stat.Gid = stat.Uid
+	stat.Mode = fuse.S_IFDIR | 0550
+	stat.Ino = emailInode(fmt.Sprintf("%s/%d/%s", email.mailbox.name, email.uid, path))
+	fillEmailTimes(email, stat)
+}
+
+func (self *EmailFs) messageFileStat(email EmailMetadata, path string, size int64, stat *fuse.Stat_t) {
+	self.messageDirStat(email, path, stat)
+	stat.Mode = fuse.S_IFREG | 0440
+	stat.Size = size
+	stat.Blocks = (stat.Size + 511) / 512
+}
+
+// Getattr of a path inside the message directory, must be called without the lock held
+func (self *EmailFs) messageGetattr(email EmailMetadata, path string, stat *fuse.Stat_t) int {
+	node, err := self.messageNode(email, path)
+	if err != nil {
+		log.Printf("Error listing attachments of message %d in %s: %v\n", email.uid, email.mailbox.name, err)
+		return -fuse.EIO
+	}
+	if node.path == "" || node.path == attachmentsDir {
+		self.messageDirStat(email, path, stat)
+		return 0
+	}
+	if strings.HasPrefix(node.path, attachmentsDir+"/") {
+		attachment, found := node.attachments[path]
+		if !found {
+			return -fuse.ENOENT
+		}
+		self.messageFileStat(email, path, attachment.size, stat)
+		return 0
+	}
+
+	parts, err := self.emailParts(email, node.attached)
+	if err != nil {
+		log.Printf("Error reading message %d in %s: %v\n", email.uid, email.mailbox.name, err)
+		return -fuse.EIO
+	}
+	data, found := parts.files(self.renderMode)[node.path]
+	if !found {
+		return -fuse.ENOENT
+	}
+	self.messageFileStat(email, path, int64(len(data)), stat)
+	return 0
+}
+
+// Readdir of the message directory, an attached message or their attachments, must be called without the lock held
+func (self *EmailFs) messageReaddir(email EmailMetadata, path string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool) int {
+	node, err := self.messageNode(email, path)
+	if err != nil {
+		log.Printf("Error listing attachments of message %d in %s: %v\n", email.uid, email.mailbox.name, err)
+		return -fuse.EIO
+	}
+	var stat fuse.Stat_t
+	if node.path == attachmentsDir {
+		for attachmentPath, attachment := range node.attachments {
+			dir, name := splitPath(attachmentPath)
+			if dir != path {
+				continue
+			}
+			if attachment.message {
+				self.messageDirStat(email, attachmentPath, &stat)
+			} else {
+				self.messageFileStat(email, attachmentPath, attachment.size, &stat)
+			}
+			if !fill(name, &stat, 0) {
+				return 1
+			}
+		}
+		return 0
+	}
+	if node.path != "" {
+		return -fuse.ENOTDIR
+	}
+
+	parts, err := self.emailParts(email, node.attached)
+	if err != nil {
+		log.Printf("Error reading message %d in %s: %v\n", email.uid, email.mailbox.name, err)
+		return -fuse.EIO
+	}
+	self.messageDirStat(email, node.fullPath(attachmentsDir), &stat)
+	if !fill(attachmentsDir, &stat, 0) {
+		return 1
+	}
+	for name, data := range parts.files(self.renderMode) {
+		self.messageFileStat(email, node.fullPath(name), int64(len(data)), &stat)
+		if !fill(name, &stat, 0) {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Opens a file inside the message directory, reporting whether its size was an estimate.
+// Must be called without the lock held
+func (self *EmailFs) messageOpen(email EmailMetadata, path string) (int, uint64, bool) {
+	node, err := self.messageNode(email, path)
+	if err != nil {
+		log.Printf("Error listing attachments of message %d in %s: %v\n", email.uid, email.mailbox.name, err)
+		return -fuse.EIO, ^uint64(0), false
+	}
+	if node.path == "" || node.path == attachmentsDir {
+		return -fuse.EISDIR, ^uint64(0), false
+	}
+	var data []byte
+	directIo := false
+	if strings.HasPrefix(node.path, attachmentsDir+"/") {
+		attachment, found := node.attachments[path]
+		if !found {
+			return -fuse.ENOENT, ^uint64(0), false
+		}
+		data, err = self.attachmentReader.readAttachment(email.mailbox.name, email.uid, attachment)
+		if err != nil {
+			log.Printf("Error reading attachment %s of message %d in %s: %v\n", path, email.uid, email.mailbox.name, err)
+			return -fuse.EIO, ^uint64(0), false
+		}
+		if !attachment.exact {
+			self.setAttachmentSize(email, path, int64(len(data)))
+			directIo = true
+		}
+	} else {
+		parts, err := self.emailParts(email, node.attached)
+		if err != nil {
+			log.Printf("Error reading message %d in %s: %v\n", email.uid, email.mailbox.name, err)
+			return -fuse.EIO, ^uint64(0), false
+		}
+		var found bool
+		data, found = parts.files(self.renderMode)[node.path]
+		if !found {
+			return -fuse.ENOENT, ^uint64(0), false
+		}
+		if node.attached == nil && strings.HasPrefix(node.path, "body.") {
+			self.markSeen(email)
+		}
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.nextFh++
+	self.openFiles[self.nextFh] = string(data)
+	return 0, self.nextFh, directIo
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Template of message filenames with fields in braces, e.g. "{date:2006-01-02} {from.name} - {subject}.txt".
+// A nil template names messages after their subjects
+type nameTemplate []templatePart
+
+// Literal text, or a field with an optional format, e.g. a Go time layout for dates
+type templatePart struct {
+	literal string
+	field   string
+	format  string
+}
+
+var templateFields = []string{"subject", "date", "received", "from", "from.name", "from.address", "uid", "size", "flags"}
+
+const defaultDateLayout = "2006-01-02"
+
+func parseNameTemplate(value string) (nameTemplate, error) {
+	var template nameTemplate
+	for value != "" {
+		start := strings.IndexByte(value, '{')
+		if start == -1 {
+			template = append(template, templatePart{literal: value})
+			break
+		}
+		if start > 0 {
+			template = append(template, templatePart{literal: value[:start]})
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end == -1 {
+			return nil, fmt.Errorf("unclosed field in template %s", value)
+		}
+		field, format, _ := strings.Cut(value[start+1:start+end], ":")
+		if !slices.Contains(templateFields, field) {
+			return nil, fmt.Errorf("unknown template field %s", field)
+		}
+		template = append(template, templatePart{field: field, format: format})
+		value = value[start+end+1:]
+	}
+	return template, nil
+}
+
+// Filename of the message. When the name is too long the subject is shortened first, so text around it is kept
+func (t nameTemplate) name(email EmailMetadata) string {
+	if t == nil {
+		return ClearFilename(email.subject)
+	}
+	values := make([]string, len(t))
+	length := 0
+	for i, part := range t {
+		values[i] = part.value(email)
+		length += len(values[i])
+	}
+	for i, part := range t {
+		if excess := length - 255; excess > 0 && part.field == "subject" {
+			shortened := truncateFilename(values[i], max(len(values[i])-excess, 0))
+			length -= len(values[i]) - len(shortened)
+			values[i] = shortened
+		}
+	}
+	return ClearFilename(strings.Join(values, ""))
+}
+
+func (p templatePart) value(email EmailMetadata) string {
+	switch p.field {
+	case "":
+		return p.literal
+	case "subject":
+		return email.subject
+	case "date":
+		return formatDate(email.date, p.format)
+	case "received":
+		return formatDate(email.receivedDate(), p.format)
+	case "from":
+		return email.from.String()
+	case "from.name":
+		if email.from.name == "" {
+			return email.from.address
+		}
+		return email.from.name
+	case "from.address":
+		return email.from.address
+	case "uid":
+		return fmt.Sprint(email.uid)
+	case "size":
+		return fmt.Sprint(email.bodyLen)
+	case "flags":
+		var flags []string
+		for _, flag := range email.flags {
+			flags = append(flags, strings.TrimPrefix(flag, "\\"))
+		}
+		return strings.Join(flags, " ")
+	}
+	return ""
+}
+
+func formatDate(date time.Time, layout string) string {
+	if date.IsZero() {
+		return ""
+	}
+	if layout == "" {
+		layout = defaultDateLayout
+	}
+	return date.Format(layout)
+}
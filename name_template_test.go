@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNameTemplate(t *testing.T) {
+	email := EmailMetadata{
+		subject: "Weekly report",
+		uid:     42,
+		bodyLen: 1024,
+		from:    EmailAddress{name: "Jane", address: "jane@x.com"},
+		date:    time.Date(2026, 1, 2, 10, 30, 0, 0, time.UTC),
+		flags:   []string{"$Important", flagSeen},
+	}
+	tests := map[string]string{
+		"{date:2006-01-02} {from.name} - {subject}.txt": "2026-01-02 Jane - Weekly report.txt",
+		"{date} {from.address} {uid} {size}":            "2026-01-02 jane@x.com 42 1024",
+		"[{flags}] {subject}":                           "[$Important Seen] Weekly report",
+		"{date:2006/01/02 15:04} {subject}":             "2026_01_02 10:30 Weekly report",
+		"{received} {subject}":                          "2026-01-02 Weekly report",
+	}
+	for value, exp := range tests {
+		template, err := parseNameTemplate(value)
+		if err != nil {
+			t.Fatalf("Template %s: %v", value, err)
+		}
+		if got := template.name(email); got != exp {
+			t.Errorf("Template %s exp %q got %q", value, exp, got)
+		}
+	}
+
+	// the subject is shortened so the rest of the name fits
+	template, _ := parseNameTemplate("{subject}.txt")
+	email.subject = strings.Repeat("ä", 200)
+	if got := template.name(email); len(got) > 255 || !strings.HasSuffix(got, "ä.txt") {
+		t.Errorf("Exp name of at most 255 bytes ending with the extension, got %d bytes %q", len(got), got)
+	}
+
+	for _, value := range []string{"{unknown}", "{subject"} {
+		if _, err := parseNameTemplate(value); err == nil {
+			t.Errorf("Exp error for template %s", value)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+)
+
+// Reads OpenPGP keys, armored or binary, unlocking secret keys with the passphrase
+func loadPgpKeyring(path string, passphrase string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entity := range keyring {
+		if entity.PrivateKey == nil || !entity.PrivateKey.Encrypted {
+			continue
+		}
+		if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+			return nil, err
+		}
+	}
+	return keyring, nil
+}
+
+// Decrypts the armored OpenPGP message of a multipart/encrypted part, checking the signature made along with the encryption
+func (self messageKeys) decryptPgp(part []byte, sender string) ([]byte, signatureStatus) {
+	data, err := entityBody(part)
+	if err != nil {
+		return nil, signatureEncrypted
+	}
+	var encrypted io.Reader = bytes.NewReader(data)
+	if block, err := armor.Decode(bytes.NewReader(data)); err == nil {
+		encrypted = block.Body
+	}
+	md, err := openpgp.ReadMessage(encrypted, self.pgp, nil, nil)
+	if err != nil {
+		log.Printf("Failed to decrypt PGP message: %v", err)
+		return nil, signatureEncrypted
+	}
+	// the signature and the integrity of the message are checked once the body is read to the end
+	plaintext, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		// a modified message or signature, what was decrypted can't be trusted
+		log.Printf("Failed to decrypt PGP message: %v", err)
+		return nil, signatureBad
+	}
+	switch {
+	case !md.IsSigned:
+		return plaintext, signatureUnsigned
+	case md.SignedBy == nil:
+		return plaintext, signatureUnknownKey
+	case md.SignatureError != nil:
+		return plaintext, signatureBad
+	case !pgpIdentifies(md.SignedBy.Entity, sender):
+		return plaintext, signatureUnknownKey
+	}
+	return plaintext, signatureValid
+}
+
+// Checks the detached signature of a multipart/signed message, made over the signed part with CRLF line breaks
+func (self messageKeys) verifyPgp(signed []byte, signaturePart []byte, sender string) signatureStatus {
+	signature, err := entityBody(signaturePart)
+	if err != nil {
+		return signatureBad
+	}
+	signer, err := openpgp.CheckArmoredDetachedSignature(self.pgp, bytes.NewReader(canonicalLineBreaks(signed)), bytes.NewReader(signature), nil)
+	switch {
+	case errors.Is(err, pgperrors.ErrUnknownIssuer):
+		return signatureUnknownKey
+	case err != nil:
+		return signatureBad
+	case !pgpIdentifies(signer, sender):
+		return signatureUnknownKey
+	}
+	return signatureValid
+}
+
+// Reports whether a user ID of the key holds the address
+func pgpIdentifies(entity *openpgp.Entity, address string) bool {
+	if entity == nil || address == "" {
+		return false
+	}
+	for _, identity := range entity.Identities {
+		if identity.UserId != nil && strings.EqualFold(identity.UserId.Email, address) {
+			return true
+		}
+	}
+	return false
+}
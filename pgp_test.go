@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/emersion/go-imap/v2"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func newTestEntity(t *testing.T, name string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+func signedMessage(t *testing.T, signer *openpgp.Entity, content string) string {
+	var signature bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&signature, signer, strings.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	return "From: vendor@example.com\r\nSubject: report\r\n" +
+		"Content-Type: multipart/signed; micalg=pgp-sha256; protocol=\"application/pgp-signature\"; boundary=\"sig\"\r\n\r\n" +
+		"--sig\r\n" + content + "\r\n--sig\r\n" +
+		"Content-Type: application/pgp-signature\r\n\r\n" + signature.String() + "\r\n--sig--\r\n"
+}
+
+func encryptedMessage(t *testing.T, recipient *openpgp.Entity, signer *openpgp.Entity, content string) string {
+	var encrypted bytes.Buffer
+	armored, err := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := openpgp.Encrypt(armored, []*openpgp.Entity{recipient}, signer, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext.Write([]byte(content))
+	plaintext.Close()
+	armored.Close()
+	return "From: vendor@example.com\r\nSubject: report\r\n" +
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"enc\"\r\n\r\n" +
+		"--enc\r\nContent-Type: application/pgp-encrypted\r\n\r\nVersion: 1\r\n" +
+		"--enc\r\nContent-Type: application/octet-stream\r\n\r\n" + encrypted.String() + "\r\n--enc--\r\n"
+}
+
+func TestPgpSignedMessages(t *testing.T) {
+	signer := newTestEntity(t, "vendor")
+	content := "Content-Type: text/plain\r\n\r\nreport text"
+	raw := signedMessage(t, signer, content)
+	tests := []struct {
+		name    string
+		raw     string
+		keyring openpgp.EntityList
+		exp     signatureStatus
+	}{
+		{"known key", raw, openpgp.EntityList{signer}, signatureValid},
+		{"unknown key", raw, nil, signatureUnknownKey},
+		{"other key", raw, openpgp.EntityList{newTestEntity(t, "other")}, signatureUnknownKey},
+		{"modified", strings.Replace(raw, "report text", "report test", 1), openpgp.EntityList{signer}, signatureBad},
+		{"LF line breaks", strings.ReplaceAll(raw, "\r\n", "\n"), openpgp.EntityList{signer}, signatureValid},
+		{"other sender", strings.Replace(raw, "vendor@example.com", "ceo@example.com", 1), openpgp.EntityList{signer}, signatureUnknownKey},
+	}
+	for _, test := range tests {
+		parts, err := parseEmail([]byte(test.raw), messageKeys{pgp: test.keyring})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if parts.signature != test.exp {
+			t.Errorf("%s: exp signature %q got %q", test.name, test.exp, parts.signature)
+		}
+		if text := string(parts.text); !strings.HasPrefix(text, "report te") {
+			t.Errorf("%s: exp the signed text got %q", test.name, text)
+		}
+	}
+}
+
+func TestPgpEncryptedMessages(t *testing.T) {
+	recipient := newTestEntity(t, "me")
+	signer := newTestEntity(t, "vendor")
+	content := "Content-Type: text/plain\r\n\r\nsecret report"
+	tests := []struct {
+		name    string
+		raw     string
+		keyring openpgp.EntityList
+		exp     signatureStatus
+		expText string
+	}{
+		{"signed", encryptedMessage(t, recipient, signer, content), openpgp.EntityList{recipient, signer}, signatureValid, "secret report"},
+		{"unknown signer", encryptedMessage(t, recipient, signer, content), openpgp.EntityList{recipient}, signatureUnknownKey, "secret report"},
+		{"other sender", strings.Replace(encryptedMessage(t, recipient, signer, content), "vendor@example.com", "ceo@example.com", 1), openpgp.EntityList{recipient, signer}, signatureUnknownKey, "secret report"},
+		{"unsigned", encryptedMessage(t, recipient, nil, content), openpgp.EntityList{recipient}, signatureUnsigned, "secret report"},
+		{"signed inside", encryptedMessage(t, recipient, nil, signedMessage(t, signer, content)), openpgp.EntityList{recipient, signer}, signatureValid, "secret report"},
+		{"no key", encryptedMessage(t, recipient, signer, content), nil, signatureEncrypted, ""},
+	}
+	for _, test := range tests {
+		parts, err := parseEmail([]byte(test.raw), messageKeys{pgp: test.keyring})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if parts.signature != test.exp {
+			t.Errorf("%s: exp signature %q got %q", test.name, test.exp, parts.signature)
+		}
+		if text := string(parts.text); text != test.expText {
+			t.Errorf("%s: exp text %q got %q", test.name, test.expText, text)
+		}
+	}
+}
+
+func TestModifiedPgpMessage(t *testing.T) {
+	recipient := newTestEntity(t, "me")
+	signer := newTestEntity(t, "vendor")
+	var encrypted bytes.Buffer
+	plaintext, err := openpgp.Encrypt(&encrypted, []*openpgp.Entity{recipient}, signer, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext.Write([]byte("Content-Type: text/plain\r\n\r\nsecret report"))
+	plaintext.Close()
+	// a flipped bit near the end fails the integrity check only once the body is read
+	data := encrypted.Bytes()
+	data[len(data)-30] ^= 1
+	raw := "Subject: report\r\n" +
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"enc\"\r\n\r\n" +
+		"--enc\r\nContent-Type: application/pgp-encrypted\r\n\r\nVersion: 1\r\n" +
+		"--enc\r\nContent-Type: application/octet-stream\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(data) + "\r\n--enc--\r\n"
+
+	parts, err := parseEmail([]byte(raw), messageKeys{pgp: openpgp.EntityList{recipient, signer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts.signature != signatureBad || len(parts.text) != 0 {
+		t.Errorf("Exp signature %q and no text, got %q and %q", signatureBad, parts.signature, parts.text)
+	}
+}
+
+func TestEncryptedMessageHasNoAttachments(t *testing.T) {
+	bodyStructure := &imap.BodyStructureMultiPart{
+		Subtype: "encrypted",
+		Children: []imap.BodyStructure{
+			&imap.BodyStructureSinglePart{Type: "application", Subtype: "pgp-encrypted", Size: 10},
+			&imap.BodyStructureSinglePart{Type: "application", Subtype: "octet-stream", Size: 900, Params: map[string]string{"name": "encrypted.asc"}},
+		},
+	}
+	if attachments := bodyAttachments(bodyStructure, nil); len(attachments) != 0 {
+		t.Errorf("Exp no attachments got %v", attachments)
+	}
+}
+
+func TestPlainMessageHasNoSignature(t *testing.T) {
+	parts, err := parseEmail([]byte("Subject: hi\r\nContent-Type: text/plain\r\n\r\nhello"), messageKeys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts.signature != "" || string(parts.text) != "hello" {
+		t.Errorf("Exp no signature and the text, got %q and %q", parts.signature, parts.text)
+	}
+}
+
+func TestSignatureStatus(t *testing.T) {
+	signer := newTestEntity(t, "vendor")
+	raw := signedMessage(t, signer, "Content-Type: text/plain\r\n\r\nreport text")
+	emailReader := FakeEmailReader{raw: raw}
+	emailNotifier := NewFakeUpdatesNotifier()
+	fs := EmailFs{rawEmailReader: &emailReader, emailNotifier: emailNotifier, messageKeys: messageKeys{pgp: openpgp.EntityList{signer}}, updateIntervalTimer: createNeverTickUpdateIntervalTimer}
+	fs.Init()
+
+	<-emailNotifier.notifyCalledChan
+
+	emailNotifier.newMessages <- EmailMetadata{subject: "report", uid: 1, secured: true}
+	emailNotifier.newMessages <- EmailMetadata{subject: "notes", uid: 2}
+	fs.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool { return true }, 0, 0)
+
+	var names []string
+	fs.Listxattr("/report", func(name string) bool {
+		names = append(names, name)
+		return true
+	})
+	if !slices.Contains(names, signatureXattr) {
+		t.Errorf("Exp %s among %s", signatureXattr, names)
+	}
+	if errCode, value := fs.Getxattr("/report", signatureXattr); errCode != 0 || string(value) != string(signatureValid) {
+		t.Errorf("Exp %q got %q errc %d", signatureValid, value, errCode)
+	}
+	if errCode, _ := fs.Getxattr("/notes", signatureXattr); errCode != -fuse.ENOATTR {
+		t.Errorf("Getxattr received %d errc instead of ENOATTR", errCode)
+	}
+
+	// the status is listed next to the message file
+	var stat fuse.Stat_t
+	if errCode := fs.Getattr("/report"+sigStatusFile, &stat, 0); errCode != 0 {
+		t.Errorf("Getattr received %d errc instead of 0", errCode)
+	}
+	if errCode := fs.Getattr("/notes"+sigStatusFile, &stat, 0); errCode != -fuse.ENOENT {
+		t.Errorf("Getattr received %d errc instead of ENOENT", errCode)
+	}
+	var fi fuse.FileInfo_t
+	if errCode := fs.OpenEx("/report"+sigStatusFile, &fi); errCode != 0 || !fi.DirectIo {
+		t.Errorf("Exp direct I/O open, got errc %d", errCode)
+	}
+	buff := make([]byte, 64)
+	if n := fs.Read("/report"+sigStatusFile, buff, 0, fi.Fh); string(buff[:n]) != string(signatureValid)+"\n" {
+		t.Errorf("Exp %q got %q", signatureValid, buff[:n])
+	}
+	if errCode := fs.Unlink("/report" + sigStatusFile); errCode != -fuse.EROFS {
+		t.Errorf("Unlink received %d errc instead of EROFS", errCode)
+	}
+
+	fs.messageDirs = true
+	if errCode := fs.Getattr("/report/"+sigStatusFile, &stat, 0); errCode != 0 || stat.Size != int64(len(signatureValid)+1) {
+		t.Errorf("Exp %s of size %d got %d, errc %d", sigStatusFile, len(signatureValid)+1, stat.Size, errCode)
+	}
+}
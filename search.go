@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// Matches of a saved search which are not listed in their mailbox are fetched up to this many per mailbox
+const searchFetchLimit = 100
+
+// Parses a saved search query like `from:alice since:2026-01-01 unseen` into IMAP SEARCH criteria.
+// Terms are separated by spaces and must all match, a term starting with "-" must not match.
+// Values with spaces can be quoted, e.g. `subject:"weekly report"`, words without a key are searched in the whole message
+func parseSearchQuery(query string) (*imap.SearchCriteria, error) {
+	// saved searches are stored one per line
+	if strings.ContainsAny(query, "\r\n") {
+		return nil, errors.New("query spans several lines")
+	}
+	terms, err := splitSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(terms) == 0 {
+		return nil, errors.New("empty query")
+	}
+
+	criteria := &imap.SearchCriteria{}
+	for _, term := range terms {
+		negate := len(term) > 1 && term[0] == '-'
+		if negate {
+			term = term[1:]
+		}
+		termCriteria, err := parseSearchTerm(term)
+		if err != nil {
+			return nil, err
+		}
+		if negate {
+			criteria.Not = append(criteria.Not, *termCriteria)
+		} else {
+			criteria.And(termCriteria)
+		}
+	}
+	return criteria, nil
+}
+
+func parseSearchTerm(term string) (*imap.SearchCriteria, error) {
+	key, value, hasValue := strings.Cut(term, ":")
+	if !hasValue {
+		switch strings.ToLower(term) {
+		case "seen":
+			return &imap.SearchCriteria{Flag: []imap.Flag{imap.FlagSeen}}, nil
+		case "unseen":
+			return &imap.SearchCriteria{NotFlag: []imap.Flag{imap.FlagSeen}}, nil
+		case "flagged":
+			return &imap.SearchCriteria{Flag: []imap.Flag{imap.FlagFlagged}}, nil
+		case "unflagged":
+			return &imap.SearchCriteria{NotFlag: []imap.Flag{imap.FlagFlagged}}, nil
+		case "answered":
+			return &imap.SearchCriteria{Flag: []imap.Flag{imap.FlagAnswered}}, nil
+		case "unanswered":
+			return &imap.SearchCriteria{NotFlag: []imap.Flag{imap.FlagAnswered}}, nil
+		case "draft":
+			return &imap.SearchCriteria{Flag: []imap.Flag{imap.FlagDraft}}, nil
+		}
+		return &imap.SearchCriteria{Text: []string{term}}, nil
+	}
+	if value == "" {
+		return nil, fmt.Errorf("missing value of %s", key)
+	}
+
+	switch key = strings.ToLower(key); key {
+	case "from", "to", "cc", "bcc", "subject":
+		return &imap.SearchCriteria{Header: []imap.SearchCriteriaHeaderField{{Key: key, Value: value}}}, nil
+	case "body":
+		return &imap.SearchCriteria{Body: []string{value}}, nil
+	case "text":
+		return &imap.SearchCriteria{Text: []string{value}}, nil
+	case "since", "before", "on":
+		date, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %s, expected YYYY-MM-DD", value)
+		}
+		switch key {
+		case "since":
+			return &imap.SearchCriteria{Since: date}, nil
+		case "before":
+			return &imap.SearchCriteria{Before: date}, nil
+		}
+		return &imap.SearchCriteria{Since: date, Before: date.AddDate(0, 0, 1)}, nil
+	case "larger", "smaller":
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		if key == "larger" {
+			return &imap.SearchCriteria{Larger: size}, nil
+		}
+		return &imap.SearchCriteria{Smaller: size}, nil
+	}
+	return nil, fmt.Errorf("unknown search key %s", key)
+}
+
+// Parses a size in bytes with an optional K or M suffix
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1024
+	case "M":
+		multiplier = 1024 * 1024
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s", value)
+	}
+	return size * multiplier, nil
+}
+
+// Splits the query by spaces outside of double quotes, removing the quotes
+func splitSearchQuery(query string) ([]string, error) {
+	var terms []string
+	var term strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+		default:
+			term.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms, nil
+}
+
+// Directory of saved searches, a subdirectory per query lists messages matching it
+type searchKind struct {
+	root     string
+	filepath string
+	// Checks a query before the search is saved
+	validate func(query string) error
+	// Runs the query against known mailboxes and messages, must be called without the lock held
+	run func(query string, mailboxes []Mailbox, emails []EmailMetadata) (map[emailId]bool, error)
+}
+
+func (self *EmailFs) searchKinds() []searchKind {
+	kinds := []searchKind{{
+		root:     "/search",
+		filepath: self.searchesFilepath,
+		validate: func(query string) error {
+			_, err := parseSearchQuery(query)
+			return err
+		},
+		run: self.imapSearch,
+	}}
+	if self.gmailSearcher != nil {
+		kinds = append(kinds, searchKind{
+			root:     "/gmail-search",
+			filepath: self.gmailSearchesFilepath,
+			validate: validateGmailQuery,
+			run:      self.gmailSearch,
+		})
+	}
+	return kinds
+}
+
+func (self *EmailFs) searchKind(root string) (searchKind, bool) {
+	for _, kind := range self.searchKinds() {
+		if kind.root == root {
+			return kind, true
+		}
+	}
+	return searchKind{}, false
+}
+
+func (self *EmailFs) imapSearch(query string, mailboxes []Mailbox, emails []EmailMetadata) (map[emailId]bool, error) {
+	ids := make(map[emailId]bool)
+	for _, mailbox := range mailboxes {
+		if mailbox.noSelect {
+			continue
+		}
+		uids, err := self.emailSearcher.search(mailbox.name, query)
+		if err != nil {
+			return nil, fmt.Errorf("searching %s: %w", mailbox.name, err)
+		}
+		for _, uid := range uids {
+			ids[emailId{mailbox: mailbox.name, uid: uid}] = true
+		}
+	}
+	return ids, nil
+}
+
+// Gmail queries are checked by Gmail, only queries which can't be saved are rejected
+func validateGmailQuery(query string) error {
+	if strings.TrimSpace(query) == "" {
+		return errors.New("empty query")
+	}
+	if strings.ContainsAny(query, "\r\n") {
+		return errors.New("query spans several lines")
+	}
+	return nil
+}
+
+// Gmail searches run in All Mail, which holds every message once, or in each mailbox when there is none
+func (self *EmailFs) gmailSearch(query string, mailboxes []Mailbox, emails []EmailMetadata) (map[emailId]bool, error) {
+	allMail := slices.IndexFunc(mailboxes, func(mailbox Mailbox) bool { return mailbox.all })
+	if allMail >= 0 {
+		mailboxes = mailboxes[allMail : allMail+1]
+	}
+	ids := make(map[emailId]bool)
+	for _, mailbox := range mailboxes {
+		if mailbox.noSelect {
+			continue
+		}
+		uids, err := self.gmailSearcher.gmailSearch(mailbox.name, query)
+		if err != nil {
+			return nil, fmt.Errorf("searching %s: %w", mailbox.name, err)
+		}
+		for _, uid := range uids {
+			ids[emailId{mailbox: mailbox.name, uid: uid}] = true
+		}
+	}
+	return ids, nil
+}
+
+// Lists messages matching saved searches of the kind, a directory per query
+func (self *EmailFs) searchDirs(root string) func(emails []EmailMetadata) map[string]map[string]EmailMetadata {
+	return func(emails []EmailMetadata) map[string]map[string]EmailMetadata {
+		listed := make(map[emailId]bool)
+		for _, email := range emails {
+			listed[email.id()] = true
+		}
+		var searched []EmailMetadata
+		for id, email := range self.searchedEmails {
+			if !listed[id] {
+				searched = append(searched, email)
+			}
+		}
+		slices.SortFunc(searched, compareIds)
+		emails = append(slices.Clip(emails), searched...)
+
+		dirs := make(map[string]map[string]EmailMetadata)
+		for query, ids := range self.searches[root] {
+			dirs[query] = make(map[string]EmailMetadata)
+			for _, email := range emails {
+				if ids[email.id()] {
+					addUniqueFile(dirs[query], email.filename, email)
+				}
+			}
+		}
+		return dirs
+	}
+}
+
+// Saves a search and runs it in background, the caller must hold the lock
+func (self *EmailFs) addSearch(kind searchKind, query string) int {
+	if err := kind.validate(query); err != nil {
+		log.Printf("Invalid search query %s: %v\n", query, err)
+		return -fuse.EINVAL
+	}
+	if _, found := self.searches[kind.root][query]; found {
+		return -fuse.EEXIST
+	}
+	self.searches[kind.root][query] = make(map[emailId]bool)
+	self.viewsDirty = true
+	saveSearches(kind.filepath, self.searches[kind.root])
+
+	mailboxes, emails := self.searchSnapshot()
+	go self.search(kind, query, mailboxes, emails)
+	return 0
+}
+
+// Removes a saved search, the caller must hold the lock
+func (self *EmailFs) removeSearch(kind searchKind, query string) int {
+	if _, found := self.searches[kind.root][query]; !found {
+		return -fuse.ENOENT
+	}
+	delete(self.searches[kind.root], query)
+	self.pruneSearchedEmails()
+	self.viewsDirty = true
+	saveSearches(kind.filepath, self.searches[kind.root])
+	return 0
+}
+
+// Reruns saved searches to keep their directories current
+func (self *EmailFs) updateSearches() {
+	self.lock.Lock()
+	// searches go through mailboxes and messages reported by the last notify
+	self.fetchUpdates()
+	queries := make(map[string][]string)
+	for root, searches := range self.searches {
+		for query := range searches {
+			queries[root] = append(queries[root], query)
+		}
+	}
+	mailboxes, emails := self.searchSnapshot()
+	self.lock.Unlock()
+
+	for _, kind := range self.searchKinds() {
+		for _, query := range queries[kind.root] {
+			self.search(kind, query, mailboxes, emails)
+		}
+	}
+}
+
+// Known mailboxes and messages to run searches against, the caller must hold the lock
+func (self *EmailFs) searchSnapshot() ([]Mailbox, []EmailMetadata) {
+	var mailboxes []Mailbox
+	for _, mailbox := range self.mailboxes {
+		mailboxes = append(mailboxes, mailbox)
+	}
+	var emails []EmailMetadata
+	for _, dirEmails := range self.emailsMetadata {
+		for _, email := range dirEmails {
+			emails = append(emails, email)
+		}
+	}
+	return mailboxes, emails
+}
+
+// Runs the search and replaces its results, must be called without the lock held
+func (self *EmailFs) search(kind searchKind, query string, mailboxes []Mailbox, emails []EmailMetadata) {
+	ids, err := kind.run(query, mailboxes, emails)
+	if err != nil {
+		log.Printf("Error running search %s: %v\n", query, err)
+		return
+	}
+	searched := self.fetchUnlisted(ids, mailboxes, emails)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, found := self.searches[kind.root][query]; found {
+		self.searches[kind.root][query] = ids
+		for _, email := range searched {
+			email.filename = self.messageName(email)
+			self.searchedEmails[email.id()] = email
+		}
+		self.pruneSearchedEmails()
+		self.viewsDirty = true
+	}
+}
+
+// Fetches metadata of matches which are not listed in their mailbox directories, these hold only the latest
+// messages. Only the newest searchFetchLimit such matches of each mailbox are fetched.
+// Must be called without the lock held
+func (self *EmailFs) fetchUnlisted(ids map[emailId]bool, mailboxes []Mailbox, emails []EmailMetadata) []EmailMetadata {
+	listed := make(map[emailId]bool)
+	for _, email := range emails {
+		listed[email.id()] = true
+	}
+	unlisted := make(map[string][]uint64)
+	for id := range ids {
+		if !listed[id] {
+			unlisted[id.mailbox] = append(unlisted[id.mailbox], id.uid)
+		}
+	}
+	var fetched []EmailMetadata
+	for _, mailbox := range mailboxes {
+		uids := unlisted[mailbox.name]
+		if len(uids) == 0 {
+			continue
+		}
+		slices.Sort(uids)
+		uids = uids[max(0, len(uids)-searchFetchLimit):]
+		emails, err := self.emailSearcher.fetch(mailbox.name, uids)
+		if err != nil {
+			log.Printf("Error fetching search matches in %s: %v\n", mailbox.name, err)
+			continue
+		}
+		for _, email := range emails {
+			email.mailbox = mailbox
+			fetched = append(fetched, email)
+		}
+	}
+	return fetched
+}
+
+// Drops fetched matches no saved search holds anymore, the caller must hold the lock
+func (self *EmailFs) pruneSearchedEmails() {
+	for id := range self.searchedEmails {
+		matching := false
+		for _, searches := range self.searches {
+			for _, ids := range searches {
+				matching = matching || ids[id]
+			}
+		}
+		if !matching {
+			delete(self.searchedEmails, id)
+		}
+	}
+}
+
+// Reads saved queries, one per line
+func loadSearches(filepath string) map[string]map[emailId]bool {
+	searches := make(map[string]map[emailId]bool)
+	if filepath == "" {
+		return searches
+	}
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error loading saved searches: %v\n", err)
+		}
+		return searches
+	}
+	for _, query := range strings.Split(string(data), "\n") {
+		if query != "" {
+			searches[query] = make(map[emailId]bool)
+		}
+	}
+	return searches
+}
+
+func saveSearches(filepath string, searches map[string]map[emailId]bool) {
+	if filepath == "" {
+		return
+	}
+	var queries []string
+	for query := range searches {
+		queries = append(queries, query+"\n")
+	}
+	slices.Sort(queries)
+	if err := os.WriteFile(filepath, []byte(strings.Join(queries, "")), 0600); err != nil {
+		log.Printf("Error saving searches: %v\n", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := map[string]*imap.SearchCriteria{
+		"from:alice since:2026-01-01 unseen": {
+			Header:  []imap.SearchCriteriaHeaderField{{Key: "from", Value: "alice"}},
+			Since:   since,
+			NotFlag: []imap.Flag{imap.FlagSeen},
+		},
+		`subject:"weekly report" -from:bob invoice`: {
+			Header: []imap.SearchCriteriaHeaderField{{Key: "subject", Value: "weekly report"}},
+			Text:   []string{"invoice"},
+			Not:    []imap.SearchCriteria{{Header: []imap.SearchCriteriaHeaderField{{Key: "from", Value: "bob"}}}},
+		},
+		"on:2026-01-01 larger:10K": {
+			Since:  since,
+			Before: since.AddDate(0, 0, 1),
+			Larger: 10 * 1024,
+		},
+	}
+	for query, exp := range tests {
+		criteria, err := parseSearchQuery(query)
+		if err != nil {
+			t.Errorf("Query %s failed: %v", query, err)
+		}
+		if !reflect.DeepEqual(exp, criteria) {
+			t.Errorf("Query %s exp %+v got %+v", query, exp, criteria)
+		}
+	}
+
+	for _, query := range []string{"", "since:yesterday", `subject:"open`, "unknown:key", "larger:many"} {
+		if _, err := parseSearchQuery(query); err == nil {
+			t.Errorf("Exp query %s to fail", query)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Outcome of checking the signature of a signed or encrypted message
+type signatureStatus string
+
+const (
+	signatureValid signatureStatus = "valid"
+	// signed with a key missing from the keyring, or a certificate not issued by a trusted CA,
+	// or with a key or certificate of someone other than the sender
+	signatureUnknownKey signatureStatus = "unknown key"
+	signatureBad        signatureStatus = "bad"
+	// encrypted but not signed
+	signatureUnsigned signatureStatus = "unsigned"
+	// encrypted with a key missing from the keyring, the signature inside can't be checked
+	signatureEncrypted signatureStatus = "encrypted"
+)
+
+// Signed and encrypted messages nest at most this deep, e.g. a signed message encrypted afterwards
+const maxSecurityLayers = 4
+
+// Keys decrypting and verifying messages of the account, the zero value verifies nothing
+type messageKeys struct {
+	pgp openpgp.EntityList
+	// S/MIME certificate and key of the account
+	smimeCert *x509.Certificate
+	smimeKey  crypto.PrivateKey
+	// CAs issuing certificates of trusted S/MIME signers
+	smimeRoots *x509.CertPool
+}
+
+// Loads keys configured in the environment: PGP_KEYRING is a file of OpenPGP keys, armored or binary,
+// and PGP_PASSPHRASE unlocks its secret keys. SMIME_BUNDLE is a PEM file of the S/MIME certificate and key,
+// signers are trusted when their certificates chain to CAs of the PEM file SMIME_CA_FILE, or of the system
+func loadMessageKeys() (messageKeys, error) {
+	var keys messageKeys
+	if path := os.Getenv("PGP_KEYRING"); path != "" {
+		keyring, err := loadPgpKeyring(path, os.Getenv("PGP_PASSPHRASE"))
+		if err != nil {
+			return messageKeys{}, fmt.Errorf("failed to load PGP keyring %s: %w", path, err)
+		}
+		keys.pgp = keyring
+	}
+	if path := os.Getenv("SMIME_BUNDLE"); path != "" {
+		cert, key, err := loadSmimeBundle(path)
+		if err != nil {
+			return messageKeys{}, fmt.Errorf("failed to load S/MIME bundle %s: %w", path, err)
+		}
+		keys.smimeCert, keys.smimeKey = cert, key
+	}
+	roots, err := loadSmimeRoots(os.Getenv("SMIME_CA_FILE"))
+	if err != nil {
+		return messageKeys{}, fmt.Errorf("failed to load S/MIME CAs: %w", err)
+	}
+	keys.smimeRoots = roots
+	return keys, nil
+}
+
+// Strips the signed and encrypted layers of a message, returning the innermost content as a MIME entity
+// and the status of its signature. Signatures are valid only when made by the sender, the address in From.
+// The status is empty for messages neither signed nor encrypted
+func (self messageKeys) unwrap(content []byte, sender string) ([]byte, signatureStatus) {
+	var status signatureStatus
+	for range maxSecurityLayers {
+		inner, layerStatus, found := self.unwrapLayer(content, sender)
+		if !found {
+			break
+		}
+		// a signature inside an encrypted message tells more than the encryption
+		if status == "" || layerStatus != signatureUnsigned {
+			status = layerStatus
+		}
+		if inner == nil {
+			break
+		}
+		content = inner
+	}
+	return content, status
+}
+
+// Strips one signed or encrypted layer, the content is nil when it can't be decrypted
+func (self messageKeys) unwrapLayer(content []byte, sender string) ([]byte, signatureStatus, bool) {
+	header, body, err := splitEntity(content)
+	if err != nil {
+		return nil, "", false
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", false
+	}
+	protocol := strings.ToLower(params["protocol"])
+	switch {
+	case mediaType == "multipart/encrypted" && protocol == "application/pgp-encrypted":
+		parts := multipartParts(body, params["boundary"])
+		if len(parts) != 2 {
+			return nil, "", false
+		}
+		inner, status := self.decryptPgp(parts[1], sender)
+		return inner, status, true
+	case mediaType == "multipart/signed" && protocol == "application/pgp-signature":
+		parts := multipartParts(body, params["boundary"])
+		if len(parts) != 2 {
+			return nil, "", false
+		}
+		return parts[0], self.verifyPgp(parts[0], parts[1], sender), true
+	case mediaType == "multipart/signed" && isSmimeSignature(protocol):
+		parts := multipartParts(body, params["boundary"])
+		if len(parts) != 2 {
+			return nil, "", false
+		}
+		return parts[0], self.verifySmimeDetached(parts[0], parts[1], sender), true
+	case mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime":
+		inner, status := self.openSmime(content, sender)
+		return inner, status, true
+	}
+	return nil, "", false
+}
+
+// Splits a MIME entity into its header and the raw body
+func splitEntity(entity []byte) (textproto.Header, []byte, error) {
+	r := bufio.NewReader(bytes.NewReader(entity))
+	header, err := textproto.ReadHeader(r)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	body, err := io.ReadAll(r)
+	return header, body, err
+}
+
+// Body of a MIME entity with its transfer encoding decoded
+func entityBody(entity []byte) ([]byte, error) {
+	e, err := message.Read(bytes.NewReader(entity))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, err
+	}
+	return io.ReadAll(e.Body)
+}
+
+// Parts of a multipart body as they are in the message, signatures are made over these bytes.
+// The line break before a boundary delimiter belongs to the delimiter
+func multipartParts(body []byte, boundary string) [][]byte {
+	if boundary == "" {
+		return nil
+	}
+	delimiter := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for offset := 0; offset < len(body); {
+		end := len(body)
+		if i := bytes.IndexByte(body[offset:], '\n'); i != -1 {
+			end = offset + i + 1
+		}
+		line := bytes.TrimRight(body[offset:end], " \t\r\n")
+		if rest, found := bytes.CutPrefix(line, delimiter); found && (len(rest) == 0 || string(rest) == "--") {
+			if start != -1 {
+				part := bytes.TrimSuffix(body[start:offset], []byte("\n"))
+				parts = append(parts, bytes.TrimSuffix(part, []byte("\r")))
+			}
+			if len(rest) != 0 {
+				return parts
+			}
+			start = end
+		}
+		offset = end
+	}
+	// a missing closing delimiter leaves the last part incomplete
+	return parts
+}
+
+// Replaces bare LF line breaks with CRLF
+func canonicalLineBreaks(data []byte) []byte {
+	var out bytes.Buffer
+	for i, b := range data {
+		if b == '\n' && (i == 0 || data[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(b)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// PKCS #9 emailAddress attribute of certificate subjects
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// Reads the certificate and private key of the account from a PEM file, the first certificate is the account's
+func loadSmimeBundle(path string) (*x509.Certificate, crypto.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cert *x509.Certificate
+	var key crypto.PrivateKey
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch {
+		case block.Type == "CERTIFICATE" && cert == nil:
+			if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, nil, err
+			}
+		case block.Type == "PRIVATE KEY" && key == nil:
+			if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+				return nil, nil, err
+			}
+		case block.Type == "RSA PRIVATE KEY" && key == nil:
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, nil, err
+			}
+		case block.Type == "EC PRIVATE KEY" && key == nil:
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if cert == nil || key == nil {
+		return nil, nil, errors.New("a certificate and a private key are required")
+	}
+	return cert, key, nil
+}
+
+// CAs of the PEM file, or of the system when no file is given
+func loadSmimeRoots(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return x509.SystemCertPool()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates in " + path)
+	}
+	return roots, nil
+}
+
+func isSmimeSignature(protocol string) bool {
+	return protocol == "application/pkcs7-signature" || protocol == "application/x-pkcs7-signature"
+}
+
+// Checks the detached signature of a multipart/signed message, made over the signed part with CRLF line breaks
+func (self messageKeys) verifySmimeDetached(signed []byte, signaturePart []byte, sender string) signatureStatus {
+	signature, err := entityBody(signaturePart)
+	if err != nil {
+		return signatureBad
+	}
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		return signatureBad
+	}
+	p7.Content = canonicalLineBreaks(signed)
+	return self.verifySmime(p7, sender)
+}
+
+// Opens an application/pkcs7-mime entity, either signed data holding the message or data encrypted for the account
+func (self messageKeys) openSmime(entity []byte, sender string) ([]byte, signatureStatus) {
+	data, err := entityBody(entity)
+	if err != nil {
+		return nil, signatureEncrypted
+	}
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		log.Printf("Failed to parse S/MIME message: %v", err)
+		return nil, signatureEncrypted
+	}
+	if len(p7.Signers) > 0 {
+		return p7.Content, self.verifySmime(p7, sender)
+	}
+	if self.smimeCert == nil {
+		return nil, signatureEncrypted
+	}
+	content, err := p7.Decrypt(self.smimeCert, self.smimeKey)
+	if err != nil {
+		log.Printf("Failed to decrypt S/MIME message: %v", err)
+		return nil, signatureEncrypted
+	}
+	return content, signatureUnsigned
+}
+
+// A signature is valid when it matches the content and the signer's certificate chains to a trusted CA
+// and is issued for the sender
+func (self messageKeys) verifySmime(p7 *pkcs7.PKCS7, sender string) signatureStatus {
+	if p7.GetOnlySigner() == nil && len(p7.Signers) == 1 {
+		// the certificate of the signer is not included
+		return signatureUnknownKey
+	}
+	if err := p7.Verify(); err != nil {
+		return signatureBad
+	}
+	if self.smimeRoots == nil || p7.VerifyWithChain(self.smimeRoots) != nil {
+		return signatureUnknownKey
+	}
+	if !smimeIdentifies(p7.GetOnlySigner(), sender) {
+		return signatureUnknownKey
+	}
+	return signatureValid
+}
+
+// Reports whether the certificate is issued for the address, in its subject alternative names
+// or in the emailAddress attribute of its subject as older certificates have it
+func smimeIdentifies(cert *x509.Certificate, address string) bool {
+	if cert == nil || address == "" {
+		return false
+	}
+	addresses := slices.Clone(cert.EmailAddresses)
+	for _, name := range cert.Subject.Names {
+		if value, ok := name.Value.(string); ok && name.Type.Equal(oidEmailAddress) {
+			addresses = append(addresses, value)
+		}
+	}
+	return slices.ContainsFunc(addresses, func(v string) bool { return strings.EqualFold(v, address) })
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/smallstep/pkcs7"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+// Issues a certificate for the name, self-signed when there is no issuer
+func newTestCert(t *testing.T, name string, issuer *testCert) testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		EmailAddresses:        []string{name + "@example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		BasicConstraintsValid: true,
+		IsCA:                  issuer == nil,
+	}
+	parent, parentKey := template, key
+	if issuer != nil {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCert{cert, key}
+}
+
+func smimeSignature(t *testing.T, signer testCert, content string, detached bool) string {
+	signedData, err := pkcs7.NewSignedData([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signedData.AddSigner(signer.cert, signer.key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if detached {
+		signedData.Detach()
+	}
+	der, err := signedData.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func smimeSignedMessage(t *testing.T, signer testCert, content string) string {
+	return "From: colleague@example.com\r\nSubject: report\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=\"sig\"\r\n\r\n" +
+		"--sig\r\n" + content + "\r\n--sig\r\n" +
+		"Content-Type: application/pkcs7-signature; name=smime.p7s\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		smimeSignature(t, signer, content, true) + "\r\n--sig--\r\n"
+}
+
+func smimeOpaqueMessage(t *testing.T, signer testCert, content string) string {
+	return "From: colleague@example.com\r\nSubject: report\r\n" +
+		"Content-Type: application/pkcs7-mime; smime-type=signed-data; name=smime.p7m\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		smimeSignature(t, signer, content, false) + "\r\n"
+}
+
+func smimeEncryptedMessage(t *testing.T, recipient testCert, content string) string {
+	der, err := pkcs7.Encrypt([]byte(content), []*x509.Certificate{recipient.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "From: colleague@example.com\r\nSubject: report\r\n" +
+		"Content-Type: application/x-pkcs7-mime; smime-type=enveloped-data; name=smime.p7m\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(der) + "\r\n"
+}
+
+func TestSmimeMessageHasNoAttachments(t *testing.T) {
+	bodyStructure := &imap.BodyStructureSinglePart{Type: "application", Subtype: "pkcs7-mime", Size: 900, Params: map[string]string{"name": "smime.p7m"}}
+	if attachments := bodyAttachments(bodyStructure, nil); len(attachments) != 0 {
+		t.Errorf("Exp no attachments got %v", attachments)
+	}
+}
+
+func TestSmimeMessages(t *testing.T) {
+	ca := newTestCert(t, "Corporate CA", nil)
+	signer := newTestCert(t, "colleague", &ca)
+	me := newTestCert(t, "me", &ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	keys := messageKeys{smimeCert: me.cert, smimeKey: me.key, smimeRoots: roots}
+
+	content := "Content-Type: text/plain\r\n\r\nquarterly report"
+	signed := smimeSignedMessage(t, signer, content)
+	tests := []struct {
+		name    string
+		raw     string
+		keys    messageKeys
+		exp     signatureStatus
+		expText string
+	}{
+		{"signed", signed, keys, signatureValid, "quarterly report"},
+		{"untrusted CA", signed, messageKeys{smimeRoots: x509.NewCertPool()}, signatureUnknownKey, "quarterly report"},
+		{"no CAs", signed, messageKeys{}, signatureUnknownKey, "quarterly report"},
+		{"modified", strings.Replace(signed, "quarterly", "annual", 1), keys, signatureBad, "annual report"},
+		{"other sender", strings.Replace(signed, "colleague@example.com", "ceo@example.com", 1), keys, signatureUnknownKey, "quarterly report"},
+		{"opaque", smimeOpaqueMessage(t, signer, content), keys, signatureValid, "quarterly report"},
+		{"encrypted", smimeEncryptedMessage(t, me, content), keys, signatureUnsigned, "quarterly report"},
+		{"signed inside", smimeEncryptedMessage(t, me, smimeSignedMessage(t, signer, content)), keys, signatureValid, "quarterly report"},
+		{"no key", smimeEncryptedMessage(t, me, content), messageKeys{smimeRoots: roots}, signatureEncrypted, ""},
+	}
+	for _, test := range tests {
+		parts, err := parseEmail([]byte(test.raw), test.keys)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if parts.signature != test.exp {
+			t.Errorf("%s: exp signature %q got %q", test.name, test.exp, parts.signature)
+		}
+		if text := string(parts.text); text != test.expText {
+			t.Errorf("%s: exp text %q got %q", test.name, test.expText, text)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"os/exec"
+	pathpkg "path"
 	"regexp"
 	"runtime"
 	"strings"
@@ -23,11 +25,7 @@ func ClearFilename(name string) string {
 	name = strings.TrimSpace(name)
 
 	// Enforce length limit (Linux NAME_MAX is usually 255 bytes)
-	for len(name) > 255 {
-		// Truncate safely without breaking Unicode
-		_, size := utf8.DecodeLastRuneInString(name)
-		name = name[:len(name)-size]
-	}
+	name = truncateFilename(name, 255)
 
 	if name == "" {
 		name = "unnamed"
@@ -36,6 +34,51 @@ func ClearFilename(name string) string {
 	return name
 }
 
+// Clears filename-prohibited characters and appends the suffix, shortening the name so the suffix always fits.
+// The suffix must be a valid filename part already
+func ClearFilenameWithSuffix(name string, suffix string) string {
+	return truncateFilename(ClearFilename(name), 255-len(suffix)) + suffix
+}
+
+// Inserts the suffix before the extension of the name, shortening the name so the suffix always fits
+func suffixFilename(name string, suffix string) string {
+	ext := pathpkg.Ext(name)
+	if strings.ContainsRune(ext, ' ') {
+		// a dot in the middle of a subject
+		ext = ""
+	}
+	return ClearFilenameWithSuffix(strings.TrimSuffix(name, ext), suffix+ext)
+}
+
+// Name for a message whose name is taken, suffixed with its UID and then numbered as well.
+// Every attempt is made from the original name, none is returned once shortening makes them repeat
+func uidFilename(name string, uid uint64, taken func(name string) bool) (string, bool) {
+	previous := ""
+	for i := 1; ; i++ {
+		suffix := fmt.Sprintf(" (%d)", uid)
+		if i > 1 {
+			suffix = fmt.Sprintf(" (%d-%d)", uid, i)
+		}
+		attempt := suffixFilename(name, suffix)
+		if attempt == previous {
+			return "", false
+		}
+		if !taken(attempt) {
+			return attempt, true
+		}
+		previous = attempt
+	}
+}
+
+func truncateFilename(name string, limit int) string {
+	for len(name) > limit {
+		// Truncate safely without breaking Unicode
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
 func openBrowser(url string) {
 	var cmd string
 	var args []string
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	pathpkg "path"
+	"slices"
+	"strings"
+)
+
+// Read-only tree of directories under root grouping messages by some property
+type emailView struct {
+	root string
+	// Directories under root the message is listed in, relative to root, the empty one is root itself
+	dirs func(email EmailMetadata) []string
+	// Used instead of dirs when grouping depends on other messages,
+	// returns files by name in directories relative to root
+	group func(emails []EmailMetadata) map[string]map[string]EmailMetadata
+}
+
+// Names of view roots, a top-level mailbox named so is listed with mailboxSuffix so the view doesn't hide it
+var viewNames = []string{"by-date", "by-sender", "threads", "unread", "flagged", "search", "gmail-search"}
+
+const mailboxSuffix = " (mailbox)"
+
+func (self *EmailFs) emailViews() []emailView {
+	views := []emailView{
+		{root: "/by-date", dirs: byDateDirs},
+		{root: "/by-sender", dirs: bySenderDirs},
+		{root: "/threads", group: threadDirs},
+		{root: "/unread", dirs: unreadDirs},
+		{root: "/flagged", dirs: flaggedDirs},
+	}
+	for _, kind := range self.searchKinds() {
+		views = append(views, emailView{root: kind.root, group: self.searchDirs(kind.root)})
+	}
+	return views
+}
+
+func byDateDirs(email EmailMetadata) []string {
+	date := email.receivedDate()
+	if date.IsZero() {
+		return nil
+	}
+	date = date.Local()
+	return []string{fmt.Sprintf("%04d/%02d/%02d", date.Year(), date.Month(), date.Day())}
+}
+
+func bySenderDirs(email EmailMetadata) []string {
+	if email.from.address == "" {
+		return nil
+	}
+	return []string{ClearFilename(strings.ToLower(email.from.address))}
+}
+
+func unreadDirs(email EmailMetadata) []string {
+	if email.hasFlag(flagSeen) {
+		return nil
+	}
+	return []string{""}
+}
+
+func flaggedDirs(email EmailMetadata) []string {
+	if !email.hasFlag(flagFlagged) {
+		return nil
+	}
+	return []string{""}
+}
+
+// Groups messages linked by references into directories named after the subject of the first message,
+// files are numbered in the order messages were received
+func threadDirs(emails []EmailMetadata) map[string]map[string]EmailMetadata {
+	roots := make(map[string]string)
+	var findRoot func(key string) string
+	findRoot = func(key string) string {
+		root, found := roots[key]
+		if !found || root == key {
+			return key
+		}
+		root = findRoot(root)
+		roots[key] = root
+		return root
+	}
+
+	unique := make(map[string]EmailMetadata)
+	for _, email := range emails {
+		unique[email.copyKey()] = email
+		key := email.threadKey()
+		for _, ref := range email.references {
+			if root, refRoot := findRoot(key), findRoot(ref); root != refRoot {
+				roots[root] = refRoot
+			}
+		}
+	}
+
+	threadsByRoot := make(map[string][]EmailMetadata)
+	for _, email := range unique {
+		root := findRoot(email.threadKey())
+		threadsByRoot[root] = append(threadsByRoot[root], email)
+	}
+	var threads [][]EmailMetadata
+	for _, thread := range threadsByRoot {
+		slices.SortFunc(thread, compareReceived)
+		threads = append(threads, thread)
+	}
+	slices.SortFunc(threads, func(a, b []EmailMetadata) int {
+		return compareReceived(a[0], b[0])
+	})
+
+	dirs := make(map[string]map[string]EmailMetadata)
+	for _, thread := range threads {
+		dir := ClearFilename(thread[0].subject)
+		for i := 2; dirs[dir] != nil; i++ {
+			dir = ClearFilenameWithSuffix(thread[0].subject, fmt.Sprintf(" (%d)", i))
+		}
+		dirs[dir] = make(map[string]EmailMetadata)
+		width := max(len(fmt.Sprint(len(thread))), 2)
+		for i, email := range thread {
+			dirs[dir][ClearFilename(fmt.Sprintf("%0*d %s", width, i+1, email.filename))] = email
+		}
+	}
+	return dirs
+}
+
+func compareIds(a, b EmailMetadata) int {
+	return cmp.Or(cmp.Compare(a.mailbox.name, b.mailbox.name), cmp.Compare(a.uid, b.uid))
+}
+
+func compareReceived(a, b EmailMetadata) int {
+	return cmp.Or(a.receivedDate().Compare(b.receivedDate()), cmp.Compare(a.threadKey(), b.threadKey()), compareIds(a, b))
+}
+
+// Display names the sender of messages in a by-sender directory used, one per line
+func (self *EmailFs) senderNames(dir string) string {
+	var names []string
+	for _, email := range self.views()[dir] {
+		if email.from.name != "" && !slices.Contains(names, email.from.name) {
+			names = append(names, email.from.name)
+		}
+	}
+	slices.Sort(names)
+	return strings.Join(names, "\n")
+}
+
+// Virtual directories of all views, rebuilt when messages change
+func (self *EmailFs) views() map[string]map[string]EmailMetadata {
+	if self.virtualDirs != nil && !self.viewsDirty {
+		return self.virtualDirs
+	}
+	self.virtualDirs = make(map[string]map[string]EmailMetadata)
+	var all []EmailMetadata
+	for _, emails := range self.emailsMetadata {
+		for _, email := range emails {
+			all = append(all, email)
+		}
+	}
+	// messages sharing a name are numbered in the same order on every rebuild
+	slices.SortFunc(all, compareIds)
+	for _, view := range self.emailViews() {
+		self.virtualDirs[view.root] = make(map[string]EmailMetadata)
+		if view.group != nil {
+			for dir, files := range view.group(all) {
+				self.addVirtualDir(view.root + "/" + dir)
+				for name, email := range files {
+					self.addVirtualFile(view.root+"/"+dir, name, email)
+				}
+			}
+			continue
+		}
+		for _, email := range all {
+			for _, dir := range view.dirs(email) {
+				self.addVirtualFile(pathpkg.Join(view.root, dir), email.filename, email)
+			}
+		}
+	}
+	self.viewsDirty = false
+	return self.virtualDirs
+}
+
+func (self *EmailFs) addVirtualFile(dir string, name string, email EmailMetadata) {
+	self.addVirtualDir(dir)
+	addUniqueFile(self.virtualDirs[dir], name, email)
+}
+
+// Adds the message to files under the name, suffixed with its UID when another message has the name
+// as in mailbox directories. Copies of a message in several Gmail labels are listed once
+func addUniqueFile(files map[string]EmailMetadata, name string, email EmailMetadata) {
+	taken := func(name string) bool {
+		other, found := files[name]
+		return found && other.copyKey() != email.copyKey()
+	}
+	if taken(name) {
+		var found bool
+		if name, found = uidFilename(name, email.uid, taken); !found {
+			return
+		}
+	}
+	if _, found := files[name]; !found {
+		files[name] = email
+	}
+}
+
+func (self *EmailFs) addVirtualDir(dir string) {
+	for ; dir != "/"; dir, _ = splitPath(dir) {
+		if self.virtualDirs[dir] == nil {
+			self.virtualDirs[dir] = make(map[string]EmailMetadata)
+		}
+	}
+}
+
+// Reports whether the path belongs to a read-only view
+func (self *EmailFs) isVirtual(path string) bool {
+	for _, view := range self.emailViews() {
+		if path == view.root || strings.HasPrefix(path, view.root+"/") {
+			return true
+		}
+	}
+	return false
+}
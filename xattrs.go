@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// Flags and keywords of the message, space-separated. Setting it stores the flags on the server
+const flagsXattr = "user.email.flags"
+
+// Signature status of signed and encrypted messages, known once the message is fetched
+const signatureXattr = "user.email.signature"
+
+// Extended attributes of message files, filled from the envelope and headers fetched with it
+var emailXattrNames = []string{
+	"user.email.from",
+	"user.email.to",
+	"user.email.cc",
+	"user.email.date",
+	"user.email.message-id",
+	"user.email.list-id",
+}
+
+// Value of the extended attribute of the message, empty when the message has no such attribute
+func emailXattr(email EmailMetadata, name string) string {
+	switch name {
+	case "user.email.from":
+		if email.from.address == "" {
+			return ""
+		}
+		return email.from.String()
+	case "user.email.to":
+		return formatAddresses(email.to)
+	case "user.email.cc":
+		return formatAddresses(email.cc)
+	case "user.email.date":
+		if email.date.IsZero() {
+			return ""
+		}
+		return email.date.Format(time.RFC3339)
+	case "user.email.message-id":
+		return email.messageId
+	case "user.email.list-id":
+		return email.listId
+	}
+	return ""
+}
+
+// Parses space-separated flags and keywords, e.g. `\Seen $Important`, into a sorted list
+func parseFlags(value string) ([]string, error) {
+	var flags []string
+	for _, flag := range strings.Fields(value) {
+		keyword := strings.TrimPrefix(flag, "\\")
+		if keyword == "" || strings.ContainsFunc(keyword, isAtomSpecial) {
+			return nil, fmt.Errorf("invalid flag %s", flag)
+		}
+		if keyword != flag && !slices.Contains(systemFlags, flag) {
+			return nil, fmt.Errorf("unknown system flag %s", flag)
+		}
+		if !slices.Contains(flags, flag) {
+			flags = append(flags, flag)
+		}
+	}
+	slices.Sort(flags)
+	return flags, nil
+}
+
+// Reports whether the character can't be a part of an IMAP flag
+func isAtomSpecial(r rune) bool {
+	return r <= ' ' || r > '~' || strings.ContainsRune(`(){%*"\]`, r)
+}
+
+// Reads the message of the file to check its signature, must be called without the lock held
+func (self *EmailFs) getSignatureXattr(path string) (int, []byte) {
+	self.lock.Lock()
+	email, found := self.lookupXattrFile(path)
+	self.lock.Unlock()
+	if !found || !email.secured {
+		return -fuse.ENOATTR, nil
+	}
+	parts, err := self.emailParts(email, nil)
+	if err != nil {
+		log.Printf("Error reading message %d in %s: %v\n", email.uid, email.mailbox.name, err)
+		return -fuse.EIO, nil
+	}
+	if parts.signature == "" {
+		return -fuse.ENOATTR, nil
+	}
+	return 0, []byte(parts.signature)
+}
+
+// Looks up the message a file with message attributes stands for, either the message file or directory or its raw file.
+// The caller must hold the lock
+func (self *EmailFs) lookupXattrFile(path string) (EmailMetadata, bool) {
+	if email, found := self.lookupFile(path); found {
+		return email, true
+	}
+	return self.lookupRawFile(path)
+}
+
+func (a EmailAddress) String() string {
+	if a.name == "" {
+		return a.address
+	}
+	return fmt.Sprintf("%s <%s>", a.name, a.address)
+}
+
+func formatAddresses(addresses []EmailAddress) string {
+	var formatted []string
+	for _, address := range addresses {
+		formatted = append(formatted, address.String())
+	}
+	return strings.Join(formatted, ", ")
+}